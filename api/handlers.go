@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+	"github.com/google/uuid"
+)
+
+type createDownloadRequest struct {
+	Url          string           `json:"url"`
+	DownloadType pkg.DownloadType `json:"downloadType"`
+}
+
+type bandwidthRequest struct {
+	Bandwidth float64 `json:"bandwidth"`
+}
+
+type errorResponse struct {
+	Error   string            `json:"error"`
+	Details *pkg.ErrorDetails `json:"details,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, utils.DownloadNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, utils.URLParseError),
+		errors.Is(err, utils.InvalidMetalink):
+		status = http.StatusBadRequest
+	case errors.Is(err, utils.DownloadNotRunning),
+		errors.Is(err, utils.DownloadNotPaused),
+		errors.Is(err, utils.DownloadAlreadyFinished),
+		errors.Is(err, utils.DownloadNotFinished),
+		errors.Is(err, utils.DownloadBusy):
+		status = http.StatusConflict
+	case errors.Is(err, utils.HttpClientIntalizationError),
+		errors.Is(err, utils.HttpRequestError),
+		errors.Is(err, utils.ServerError),
+		errors.Is(err, utils.InvalidResourceSize),
+		errors.Is(err, utils.MetalinkUnavailable):
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error(), Details: utils.ErrorDetails(err)})
+}
+
+func getDownloaderId(r *http.Request) (uuid.UUID, error) {
+	downloaderId, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		return uuid.Nil, utils.DownloadNotFound
+	}
+	return downloaderId, nil
+}
+
+func (server *Server) createDownload(w http.ResponseWriter, r *http.Request) {
+	if utils.IsMetalink("", r.Header.Get("Content-Type")) {
+		server.createMetalinkDownload(w, r)
+		return
+	}
+
+	var request createDownloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "Invalid request body " + err.Error()})
+		return
+	}
+	if request.Url == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "Request body must contain a download url"})
+		return
+	}
+
+	downloader, err := server.manager.Submit(r.Context(), request.Url, &request.DownloadType)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, downloader.GetInfo())
+}
+
+// createMetalinkDownload takes the metalink document as the body, the
+// priority is given in the query
+func (server *Server) createMetalinkDownload(w http.ResponseWriter, r *http.Request) {
+	var downloadType pkg.DownloadType
+	if err := downloadType.Priority.UnmarshalText([]byte(r.URL.Query().Get("priority"))); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	downloader, err := server.manager.SubmitMetalink(r.Context(), r.Body, &downloadType)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, downloader.GetInfo())
+}
+
+func (server *Server) listDownloads(w http.ResponseWriter, r *http.Request) {
+	downloads := []pkg.DownloadInfo{}
+	for _, downloader := range server.manager.List() {
+		downloads = append(downloads, downloader.GetInfo())
+	}
+	writeJSON(w, http.StatusOK, downloads)
+}
+
+func (server *Server) getDownload(w http.ResponseWriter, r *http.Request) {
+	downloaderId, err := getDownloaderId(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	downloader, err := server.manager.Get(downloaderId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, downloader.GetInfo())
+}
+
+func (server *Server) deleteDownload(w http.ResponseWriter, r *http.Request) {
+	downloaderId, err := getDownloaderId(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	deleteFile := r.URL.Query().Get("deleteFile") == "true"
+	if err := server.manager.Remove(downloaderId, deleteFile); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) pauseDownload(w http.ResponseWriter, r *http.Request) {
+	server.controlDownload(w, r, server.manager.Pause)
+}
+
+func (server *Server) resumeDownload(w http.ResponseWriter, r *http.Request) {
+	server.controlDownload(w, r, server.manager.Resume)
+}
+
+func (server *Server) cancelDownload(w http.ResponseWriter, r *http.Request) {
+	server.controlDownload(w, r, server.manager.Cancel)
+}
+
+// verifyDownload checks a finished download, the verification runs in the background
+func (server *Server) verifyDownload(w http.ResponseWriter, r *http.Request) {
+	downloaderId, err := getDownloaderId(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := server.manager.Verify(downloaderId); err != nil {
+		writeError(w, err)
+		return
+	}
+	downloader, err := server.manager.Get(downloaderId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, downloader.GetInfo())
+}
+
+// setDownloadBandwidth limits a download, a bandwidth of 0 removes the limit
+func (server *Server) setDownloadBandwidth(w http.ResponseWriter, r *http.Request) {
+	downloaderId, err := getDownloaderId(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var request bandwidthRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Bandwidth < 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "Request body must contain a bandwidth of at least 0"})
+		return
+	}
+	if err := server.manager.SetDownloadBandwidth(downloaderId, request.Bandwidth); err != nil {
+		writeError(w, err)
+		return
+	}
+	downloader, err := server.manager.Get(downloaderId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, downloader.GetInfo())
+}
+
+func (server *Server) getBandwidth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, server.manager.GetBandwidth())
+}
+
+// setBandwidth replaces the global and host limits
+func (server *Server) setBandwidth(w http.ResponseWriter, r *http.Request) {
+	var limits pkg.BandwidthLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "Invalid request body " + err.Error()})
+		return
+	}
+	valid := limits.Global >= 0 && limits.PerHost >= 0
+	for _, rate := range limits.Hosts {
+		valid = valid && rate >= 0
+	}
+	if !valid {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "Bandwidth limits must not be negative"})
+		return
+	}
+	server.manager.SetBandwidth(limits)
+	writeJSON(w, http.StatusOK, server.manager.GetBandwidth())
+}
+
+// controlDownload applies a control action and responds with the new state of the download
+func (server *Server) controlDownload(w http.ResponseWriter, r *http.Request, action func(uuid.UUID) error) {
+	downloaderId, err := getDownloaderId(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := action(downloaderId); err != nil {
+		writeError(w, err)
+		return
+	}
+	downloader, err := server.manager.Get(downloaderId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, downloader.GetInfo())
+}
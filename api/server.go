@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/arun-kushwaha04/DownloadHub/service"
+)
+
+type Server struct {
+	manager *service.Manager
+	mux     *http.ServeMux
+}
+
+func NewServer(manager *service.Manager) *Server {
+	server := &Server{
+		manager: manager,
+		mux:     http.NewServeMux(),
+	}
+
+	server.mux.HandleFunc("POST /downloads", server.createDownload)
+	server.mux.HandleFunc("GET /downloads", server.listDownloads)
+	server.mux.HandleFunc("GET /downloads/{id}", server.getDownload)
+	server.mux.HandleFunc("DELETE /downloads/{id}", server.deleteDownload)
+	server.mux.HandleFunc("POST /downloads/{id}/pause", server.pauseDownload)
+	server.mux.HandleFunc("POST /downloads/{id}/resume", server.resumeDownload)
+	server.mux.HandleFunc("POST /downloads/{id}/cancel", server.cancelDownload)
+	server.mux.HandleFunc("POST /downloads/{id}/verify", server.verifyDownload)
+	server.mux.HandleFunc("PUT /downloads/{id}/bandwidth", server.setDownloadBandwidth)
+	server.mux.HandleFunc("GET /bandwidth", server.getBandwidth)
+	server.mux.HandleFunc("PUT /bandwidth", server.setBandwidth)
+
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+func (server *Server) ListenAndServe(address string) error {
+	fmt.Println("Listening on", address)
+	return http.ListenAndServe(address, server)
+}
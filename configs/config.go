@@ -1,88 +1,374 @@
 package configs
 
-var DOWNLOAD_DIRECTORY = "/media/runa/NAS/Downloads"
-var TEMP_DIRECTORY = "/media/runa/NAS/Downloads/.temp"
-
-// var DOWNLOAD_DIRECTORY = "/downloads"
-// var TEMP_DIRECTORY = "/downloads/.temp"
-var TEMP_EXT = ".tmpDownload"
-var SEG_EXT = ".seg"
-var BUFF_SIZE = 1024 * 1024 // 1 MB
-var FILE_BUFF_SIZE = 1024 * 1024
-var DEFAULT_USER_AGENT = "Mozilla/5.0 (Macintosh; Intel Mac OS X x.y; rv:10.0) Gecko/20100101 Firefox/10.0"
-var SEGMENT_SIZE int64 = 1024 * 1024 * 5
-var BANDWIDTH float64 = 1024 * 1024 * 50
-
-var VIDEO_SUB_FOLDER = "Video"
-var PROGRAMS_SUB_FOLDER = "Program"
-var MUSIC_SUB_FOLDER = "Music"
-var DOCUMENT_SUB_FOLDER = "Document"
-var COMPRESSED_SUB_FOLDER = "Compressed"
-var GENERAL_SUB_FOLDER = "General"
-var VideoExtensions = []string{
-	".mp4",
-	".avi",
-	".mov",
-	".mkv",
-	".wmv",
-	".flv",
-	".webm",
-	".mpeg",
-	".mpg",
-	".3gp",
-	".m4v",
-	".ts",
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// file names used by the downloader, these are not configurable
+const TEMP_EXT = ".tmpDownload"
+const SEG_EXT = ".seg"
+const JOURNAL_FILE = "download.journal"
+
+const CONFIG_PATH_ENV = "DOWNLOADHUB_CONFIG"
+const DEFAULT_CONFIG_PATH = "config.yaml"
+
+type Category struct {
+	Folder     string   `yaml:"folder"`
+	Extensions []string `yaml:"extensions"`
+}
+
+// Config holds every setting of DownloadHub, values are read from a yaml file
+// and can be overridden with the environment variable named in the env tag
+type Config struct {
+	DownloadDirectory string `yaml:"downloadDirectory" env:"DOWNLOADHUB_DOWNLOAD_DIRECTORY"`
+	TempDirectory     string `yaml:"tempDirectory" env:"DOWNLOADHUB_TEMP_DIRECTORY"` // defaults to <downloadDirectory>/.temp
+	ServerAddress     string `yaml:"serverAddress" env:"DOWNLOADHUB_SERVER_ADDRESS"`
+
+	UserAgent      string  `yaml:"userAgent" env:"DOWNLOADHUB_USER_AGENT"`
+	BuffSize       int     `yaml:"buffSize" env:"DOWNLOADHUB_BUFF_SIZE"`
+	FileBuffSize   int     `yaml:"fileBuffSize" env:"DOWNLOADHUB_FILE_BUFF_SIZE"`
+	SegmentSize    int64   `yaml:"segmentSize" env:"DOWNLOADHUB_SEGMENT_SIZE"`
+	Bandwidth      float64 `yaml:"bandwidth" env:"DOWNLOADHUB_BANDWIDTH"` // bytes per second, 0 is unlimited
+	MaxConnections int     `yaml:"maxConnections" env:"DOWNLOADHUB_MAX_CONNECTIONS"`
+
+	// threads write into the download file itself instead of segment files,
+	// the merge of the segments is not needed
+	DirectWrite bool `yaml:"directWrite" env:"DOWNLOADHUB_DIRECT_WRITE"`
+
+	MaxActiveDownloads int `yaml:"maxActiveDownloads" env:"DOWNLOADHUB_MAX_ACTIVE_DOWNLOADS"`
+
+	// a range failing with a timeout, a dropped connection, 5xx or 429 is
+	// requested again after a delay doubling from RetryDelay up to
+	// RetryMaxDelay, milliseconds
+	RetryAttempts int `yaml:"retryAttempts" env:"DOWNLOADHUB_RETRY_ATTEMPTS"`
+	RetryDelay    int `yaml:"retryDelay" env:"DOWNLOADHUB_RETRY_DELAY"`
+	RetryMaxDelay int `yaml:"retryMaxDelay" env:"DOWNLOADHUB_RETRY_MAX_DELAY"`
+
+	// timeouts of a connection in milliseconds, 0 waits forever. ReadTimeout
+	// is the longest the server may send nothing while a range is read.
+	ConnectTimeout        int `yaml:"connectTimeout" env:"DOWNLOADHUB_CONNECT_TIMEOUT"`
+	TLSHandshakeTimeout   int `yaml:"tlsHandshakeTimeout" env:"DOWNLOADHUB_TLS_HANDSHAKE_TIMEOUT"`
+	ResponseHeaderTimeout int `yaml:"responseHeaderTimeout" env:"DOWNLOADHUB_RESPONSE_HEADER_TIMEOUT"`
+	ReadTimeout           int `yaml:"readTimeout" env:"DOWNLOADHUB_READ_TIMEOUT"`
+
+	// a connection slower than StallSpeed bytes per second for StallTime
+	// milliseconds is closed and its range requested again, 0 disables it
+	StallSpeed float64 `yaml:"stallSpeed" env:"DOWNLOADHUB_STALL_SPEED"`
+	StallTime  int     `yaml:"stallTime" env:"DOWNLOADHUB_STALL_TIME"`
+
+	// bytes per second downloaded from one host, hosts listed in
+	// HostBandwidths get their own limit
+	HostBandwidth  float64            `yaml:"hostBandwidth" env:"DOWNLOADHUB_HOST_BANDWIDTH"`
+	HostBandwidths map[string]float64 `yaml:"hostBandwidths"`
+
+	// the first open window replaces the global bandwidth or pauses every
+	// download, outside of all windows the bandwidth above applies
+	Schedule []ScheduleWindow `yaml:"schedule"`
+
+	// a file is saved in the folder of the first category listing its extension
+	Categories    []Category `yaml:"categories"`
+	GeneralFolder string     `yaml:"generalFolder" env:"DOWNLOADHUB_GENERAL_FOLDER"`
+}
+
+func Default() *Config {
+	return &Config{
+		DownloadDirectory: "/downloads",
+		TempDirectory:     "/downloads/.temp",
+		ServerAddress:     ":8080",
+
+		UserAgent:      "Mozilla/5.0 (Macintosh; Intel Mac OS X x.y; rv:10.0) Gecko/20100101 Firefox/10.0",
+		BuffSize:       1024 * 1024, // 1 MB
+		FileBuffSize:   1024 * 1024,
+		SegmentSize:    1024 * 1024 * 5,
+		Bandwidth:      1024 * 1024 * 50,
+		MaxConnections: 40,
+
+		MaxActiveDownloads: 3,
+
+		RetryAttempts: 5,
+		RetryDelay:    1000,
+		RetryMaxDelay: 60000,
+
+		ConnectTimeout:        10000,
+		TLSHandshakeTimeout:   10000,
+		ResponseHeaderTimeout: 30000,
+		ReadTimeout:           30000,
+
+		StallSpeed: 1024,
+		StallTime:  30000,
+
+		Categories: []Category{
+			{
+				Folder: "Video",
+				Extensions: []string{
+					".mp4",
+					".avi",
+					".mov",
+					".mkv",
+					".wmv",
+					".flv",
+					".webm",
+					".mpeg",
+					".mpg",
+					".3gp",
+					".m4v",
+					".ts",
+				},
+			},
+			{
+				Folder: "Music",
+				Extensions: []string{
+					".mp3",
+					".wav",
+					".aac",
+					".ogg",
+					".flac",
+					".m4a",
+					".wma",
+					".aiff",
+					".opus",
+					".mid",
+				},
+			},
+			{
+				Folder: "Program",
+				Extensions: []string{
+					".exe", // Windows Executable
+					".msi", // Windows Installer
+					".apk", // Android Package
+					".dmg", // macOS Disk Image
+					".deb", // Debian Package
+					".rpm", // Red Hat Package
+					".bin", // Binary file
+					".jar", // Java Archive
+					".py",  // Python Script
+					".sh",  // Shell Script
+					".bat", // Batch file
+				},
+			},
+			{
+				Folder: "Compressed",
+				Extensions: []string{
+					".zip",
+					".tar",
+					".gz",
+					".bz2",
+					".7z",
+					".rar",
+					".xz",
+					".tgz",
+					".tbz",
+					".zipx",
+				},
+			},
+			{
+				Folder: "Document",
+				Extensions: []string{
+					".pdf",
+					".doc",
+					".docx",
+					".ppt",
+					".pptx",
+					".xls",
+					".xlsx",
+					".txt",
+					".csv",
+					".rtf",
+					".md",
+				},
+			},
+		},
+		GeneralFolder: "General",
+	}
 }
-var ProgramExtensions = []string{
-	".exe", // Windows Executable
-	".msi", // Windows Installer
-	".apk", // Android Package
-	".dmg", // macOS Disk Image
-	".deb", // Debian Package
-	".rpm", // Red Hat Package
-	".bin", // Binary file
-	".jar", // Java Archive
-	".py",  // Python Script
-	".sh",  // Shell Script
-	".bat", // Batch file
+
+var current = Default()
+var currentMutex sync.RWMutex
+
+// Get returns the configuration loaded at startup, it must not be modified
+func Get() *Config {
+	currentMutex.RLock()
+	defer currentMutex.RUnlock()
+	return current
 }
 
-var CompressedExtensions = []string{
-	".zip",
-	".tar",
-	".gz",
-	".bz2",
-	".7z",
-	".rar",
-	".xz",
-	".tgz",
-	".tbz",
-	".zipx",
+// Set replaces the configuration, it is meant to be called once at startup
+func Set(config *Config) {
+	currentMutex.Lock()
+	current = config
+	currentMutex.Unlock()
 }
 
-var DocumentExtensions = []string{
-	".pdf",
-	".doc",
-	".docx",
-	".ppt",
-	".pptx",
-	".xls",
-	".xlsx",
-	".txt",
-	".csv",
-	".rtf",
-	".md",
+// Load reads the config file on top of the defaults, applies the environment
+// overrides and validates the result. An empty path falls back to the path
+// in DOWNLOADHUB_CONFIG and then to config.yaml, a missing default file is
+// not an error.
+func Load(configPath string) (*Config, error) {
+	config := Default()
+	config.TempDirectory = ""
+
+	explicit := configPath != ""
+	if !explicit {
+		configPath = os.Getenv(CONFIG_PATH_ENV)
+		explicit = configPath != ""
+	}
+	if !explicit {
+		configPath = DEFAULT_CONFIG_PATH
+	}
+
+	content, err := os.ReadFile(configPath)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(content, config); err != nil {
+			return nil, fmt.Errorf("config %s: %w", configPath, err)
+		}
+	case os.IsNotExist(err) && !explicit:
+	default:
+		return nil, fmt.Errorf("config %s: %w", configPath, err)
+	}
+
+	if err := applyEnv(config); err != nil {
+		return nil, err
+	}
+
+	if config.TempDirectory == "" {
+		config.TempDirectory = filepath.Join(config.DownloadDirectory, ".temp")
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", configPath, err)
+	}
+
+	return config, nil
+}
+
+// applyEnv overrides every field having an env tag with the environment variable value
+func applyEnv(config *Config) error {
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch field.Type.Kind() {
+		case reflect.String:
+			value.Field(i).SetString(env)
+		case reflect.Bool:
+			parsed, err := strconv.ParseBool(env)
+			if err != nil {
+				return fmt.Errorf("environment variable %s: %q is not a boolean", name, env)
+			}
+			value.Field(i).SetBool(parsed)
+		case reflect.Int, reflect.Int64:
+			var parsed int64
+			parsed, err = strconv.ParseInt(env, 10, 64)
+			value.Field(i).SetInt(parsed)
+		case reflect.Float64:
+			var parsed float64
+			parsed, err = strconv.ParseFloat(env, 64)
+			value.Field(i).SetFloat(parsed)
+		}
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %q is not a number", name, env)
+		}
+	}
+	return nil
 }
 
-var MusicExtensions = []string{
-	".mp3",
-	".wav",
-	".aac",
-	".ogg",
-	".flac",
-	".m4a",
-	".wma",
-	".aiff",
-	".opus",
-	".mid",
+func (config *Config) Validate() error {
+	var errs []error
+	if config.DownloadDirectory == "" {
+		errs = append(errs, errors.New("downloadDirectory must be set"))
+	}
+	if config.ServerAddress == "" {
+		errs = append(errs, errors.New("serverAddress must be set"))
+	}
+	if config.BuffSize <= 0 {
+		errs = append(errs, errors.New("buffSize must be greater than 0"))
+	}
+	if config.FileBuffSize <= 0 {
+		errs = append(errs, errors.New("fileBuffSize must be greater than 0"))
+	}
+	if config.SegmentSize <= 0 {
+		errs = append(errs, errors.New("segmentSize must be greater than 0"))
+	}
+	if config.Bandwidth < 0 {
+		errs = append(errs, errors.New("bandwidth must not be negative"))
+	}
+	if config.HostBandwidth < 0 {
+		errs = append(errs, errors.New("hostBandwidth must not be negative"))
+	}
+	for host, rate := range config.HostBandwidths {
+		if rate < 0 {
+			errs = append(errs, fmt.Errorf("hostBandwidths[%s] must not be negative", host))
+		}
+	}
+	for i := range config.Schedule {
+		if err := config.Schedule[i].Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("schedule[%d]: %w", i, err))
+		}
+	}
+	if config.MaxConnections <= 0 {
+		errs = append(errs, errors.New("maxConnections must be greater than 0"))
+	}
+	if config.MaxActiveDownloads <= 0 {
+		errs = append(errs, errors.New("maxActiveDownloads must be greater than 0"))
+	}
+	if config.RetryAttempts < 0 {
+		errs = append(errs, errors.New("retryAttempts must not be negative"))
+	}
+	if config.RetryDelay < 0 {
+		errs = append(errs, errors.New("retryDelay must not be negative"))
+	}
+	if config.RetryMaxDelay < config.RetryDelay {
+		errs = append(errs, errors.New("retryMaxDelay must not be lower than retryDelay"))
+	}
+	if config.ConnectTimeout < 0 {
+		errs = append(errs, errors.New("connectTimeout must not be negative"))
+	}
+	if config.TLSHandshakeTimeout < 0 {
+		errs = append(errs, errors.New("tlsHandshakeTimeout must not be negative"))
+	}
+	if config.ResponseHeaderTimeout < 0 {
+		errs = append(errs, errors.New("responseHeaderTimeout must not be negative"))
+	}
+	if config.ReadTimeout < 0 {
+		errs = append(errs, errors.New("readTimeout must not be negative"))
+	}
+	if config.StallTime < 0 {
+		errs = append(errs, errors.New("stallTime must not be negative"))
+	}
+	if config.StallSpeed < 0 {
+		errs = append(errs, errors.New("stallSpeed must not be negative"))
+	}
+	if config.GeneralFolder == "" {
+		errs = append(errs, errors.New("generalFolder must be set"))
+	}
+	for i, category := range config.Categories {
+		if category.Folder == "" {
+			errs = append(errs, fmt.Errorf("categories[%d].folder must be set", i))
+		}
+		for _, ext := range category.Extensions {
+			if !strings.HasPrefix(ext, ".") {
+				errs = append(errs, fmt.Errorf("categories[%d].extensions: %q must start with a dot", i, ext))
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
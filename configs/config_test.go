@@ -0,0 +1,111 @@
+package configs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string            // written to the config path, nothing is written when empty
+		env     map[string]string // set for the test only
+		wantErr string            // part of the error, empty when Load succeeds
+		check   func(t *testing.T, config *Config)
+	}{
+		{
+			name: "defaults without a file",
+			check: func(t *testing.T, config *Config) {
+				if config.DownloadDirectory != "/downloads" || config.TempDirectory != "/downloads/.temp" {
+					t.Fatalf("directories %s %s", config.DownloadDirectory, config.TempDirectory)
+				}
+				if config.MaxConnections != Default().MaxConnections {
+					t.Fatalf("maxConnections %d", config.MaxConnections)
+				}
+			},
+		},
+		{
+			name: "file on top of the defaults",
+			file: "downloadDirectory: /data\nmaxConnections: 8\ndirectWrite: true\nschedule:\n  - {days: [mon], from: \"01:00\", to: \"06:00\", bandwidth: 100}\n",
+			check: func(t *testing.T, config *Config) {
+				if config.DownloadDirectory != "/data" || config.TempDirectory != "/data/.temp" {
+					t.Fatalf("directories %s %s", config.DownloadDirectory, config.TempDirectory)
+				}
+				if config.MaxConnections != 8 || !config.DirectWrite || len(config.Schedule) != 1 {
+					t.Fatalf("file values not applied: %+v", config)
+				}
+				if config.SegmentSize != Default().SegmentSize {
+					t.Fatalf("segmentSize %d", config.SegmentSize)
+				}
+			},
+		},
+		{
+			name: "environment over the file",
+			file: "downloadDirectory: /data\nbandwidth: 100\n",
+			env: map[string]string{
+				"DOWNLOADHUB_DOWNLOAD_DIRECTORY": "/env",
+				"DOWNLOADHUB_TEMP_DIRECTORY":     "/tmp/env",
+				"DOWNLOADHUB_BANDWIDTH":          "2.5",
+				"DOWNLOADHUB_SEGMENT_SIZE":       "1024",
+				"DOWNLOADHUB_DIRECT_WRITE":       "true",
+			},
+			check: func(t *testing.T, config *Config) {
+				if config.DownloadDirectory != "/env" || config.TempDirectory != "/tmp/env" {
+					t.Fatalf("directories %s %s", config.DownloadDirectory, config.TempDirectory)
+				}
+				if config.Bandwidth != 2.5 || config.SegmentSize != 1024 || !config.DirectWrite {
+					t.Fatalf("environment not applied: %+v", config)
+				}
+			},
+		},
+		{name: "invalid yaml", file: "maxConnections: [", wantErr: "config"},
+		{name: "invalid number", env: map[string]string{"DOWNLOADHUB_MAX_CONNECTIONS": "many"}, wantErr: "DOWNLOADHUB_MAX_CONNECTIONS"},
+		{name: "invalid boolean", env: map[string]string{"DOWNLOADHUB_DIRECT_WRITE": "sometimes"}, wantErr: "DOWNLOADHUB_DIRECT_WRITE"},
+		{name: "invalid value", file: "segmentSize: 0\n", wantErr: "segmentSize"},
+		{name: "invalid schedule", file: "schedule:\n  - {from: \"25:00\", to: \"06:00\"}\n", wantErr: "schedule"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the environment of the machine running the tests is ignored
+			for _, env := range os.Environ() {
+				if name, _, _ := strings.Cut(env, "="); strings.HasPrefix(name, "DOWNLOADHUB_") {
+					t.Setenv(name, "")
+					os.Unsetenv(name)
+				}
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if test.file != "" {
+				if err := os.WriteFile(configPath, []byte(test.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+				// an empty path passed to Load falls back to DOWNLOADHUB_CONFIG
+				t.Setenv(CONFIG_PATH_ENV, configPath)
+			}
+
+			config, err := Load("")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one about %s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.check(t, config)
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "missing.yaml")
+	if _, err := Load(configPath); err == nil {
+		t.Fatal("a missing config file given explicitly was accepted")
+	}
+}
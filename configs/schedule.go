@@ -0,0 +1,116 @@
+package configs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ScheduleWindow sets the global bandwidth, or pauses every download, on the
+// listed days between From and To in local time. A window whose To is not
+// after its From runs past midnight into the next day, an empty Days list
+// means every day.
+type ScheduleWindow struct {
+	Days      []string `yaml:"days"`      // mon, tue, ... or full weekday names
+	From      string   `yaml:"from"`      // HH:MM
+	To        string   `yaml:"to"`        // HH:MM, 24:00 is the end of the day
+	Bandwidth float64  `yaml:"bandwidth"` // bytes per second, 0 is unlimited
+	Paused    bool     `yaml:"paused"`
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time
+func parseClock(clock string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hour, &minute); err != nil || len(clock) != 5 {
+		return 0, fmt.Errorf("%q is not a HH:MM time", clock)
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("%q is not a time of the day", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+func parseWeekday(day string) (time.Weekday, bool) {
+	day = strings.ToLower(day)
+	if len(day) < 3 {
+		return 0, false
+	}
+	weekday, ok := weekdays[day[:3]]
+	return weekday, ok && strings.HasPrefix(strings.ToLower(weekday.String()), day)
+}
+
+func (window *ScheduleWindow) Validate() error {
+	var errs []error
+	for _, day := range window.Days {
+		if _, ok := parseWeekday(day); !ok {
+			errs = append(errs, fmt.Errorf("%q is not a weekday", day))
+		}
+	}
+	if _, err := parseClock(window.From); err != nil {
+		errs = append(errs, fmt.Errorf("from: %w", err))
+	}
+	if _, err := parseClock(window.To); err != nil {
+		errs = append(errs, fmt.Errorf("to: %w", err))
+	}
+	if window.Bandwidth < 0 {
+		errs = append(errs, errors.New("bandwidth must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// onDay reports whether the window starts on the given weekday
+func (window *ScheduleWindow) onDay(weekday time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, day := range window.Days {
+		if parsed, _ := parseWeekday(day); parsed == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether the window is open at the given time, the window
+// must be valid
+func (window *ScheduleWindow) Contains(t time.Time) bool {
+	from, _ := parseClock(window.From)
+	to, _ := parseClock(window.To)
+	now := t.Hour()*60 + t.Minute()
+	if from < to {
+		return window.onDay(t.Weekday()) && now >= from && now < to
+	}
+	// the window runs past midnight, its end belongs to the previous day
+	return (window.onDay(t.Weekday()) && now >= from) ||
+		(window.onDay(t.AddDate(0, 0, -1).Weekday()) && now < to)
+}
+
+func (window *ScheduleWindow) String() string {
+	days := "every day"
+	if len(window.Days) > 0 {
+		days = strings.Join(window.Days, ",")
+	}
+	return fmt.Sprintf("%s %s-%s", days, window.From, window.To)
+}
+
+// ActiveWindow returns the index of the first schedule window open at the
+// given time, -1 when none is
+func (config *Config) ActiveWindow(t time.Time) int {
+	for i := range config.Schedule {
+		if config.Schedule[i].Contains(t) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,72 @@
+package configs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleWindowContains(t *testing.T) {
+	// 2024-01-01 is a monday
+	at := func(day int, clock string) time.Time {
+		minutes, err := parseClock(clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC).Add(time.Duration(minutes) * time.Minute)
+	}
+
+	tests := []struct {
+		name   string
+		window ScheduleWindow
+		time   time.Time
+		want   bool
+	}{
+		{"inside", ScheduleWindow{From: "09:00", To: "17:00"}, at(1, "12:00"), true},
+		{"at start", ScheduleWindow{From: "09:00", To: "17:00"}, at(1, "09:00"), true},
+		{"at end", ScheduleWindow{From: "09:00", To: "17:00"}, at(1, "17:00"), false},
+		{"before", ScheduleWindow{From: "09:00", To: "17:00"}, at(1, "08:59"), false},
+		{"end of day", ScheduleWindow{From: "22:00", To: "24:00"}, at(1, "23:59"), true},
+		{"listed day", ScheduleWindow{Days: []string{"mon"}, From: "09:00", To: "17:00"}, at(1, "12:00"), true},
+		{"full day name", ScheduleWindow{Days: []string{"Monday"}, From: "09:00", To: "17:00"}, at(1, "12:00"), true},
+		{"other day", ScheduleWindow{Days: []string{"tue"}, From: "09:00", To: "17:00"}, at(1, "12:00"), false},
+		{"overnight before midnight", ScheduleWindow{From: "22:00", To: "06:00"}, at(1, "23:00"), true},
+		{"overnight after midnight", ScheduleWindow{From: "22:00", To: "06:00"}, at(2, "05:59"), true},
+		{"overnight outside", ScheduleWindow{From: "22:00", To: "06:00"}, at(2, "06:00"), false},
+		{"overnight from listed day", ScheduleWindow{Days: []string{"mon"}, From: "22:00", To: "06:00"}, at(2, "03:00"), true},
+		{"overnight into listed day", ScheduleWindow{Days: []string{"tue"}, From: "22:00", To: "06:00"}, at(2, "03:00"), false},
+		{"whole day", ScheduleWindow{From: "00:00", To: "00:00"}, at(3, "15:00"), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.window.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := test.window.Contains(test.time); got != test.want {
+				t.Fatalf("%s at %s: got %v, want %v", test.window.String(), test.time.Format("Mon 15:04"), got, test.want)
+			}
+		})
+	}
+}
+
+func TestScheduleWindowValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		window ScheduleWindow
+		valid  bool
+	}{
+		{"valid", ScheduleWindow{Days: []string{"sat", "sunday"}, From: "01:30", To: "24:00"}, true},
+		{"unknown day", ScheduleWindow{Days: []string{"someday"}, From: "01:00", To: "02:00"}, false},
+		{"short day", ScheduleWindow{Days: []string{"mo"}, From: "01:00", To: "02:00"}, false},
+		{"bad clock", ScheduleWindow{From: "1:00", To: "02:00"}, false},
+		{"past midnight", ScheduleWindow{From: "01:00", To: "24:01"}, false},
+		{"bad minutes", ScheduleWindow{From: "01:60", To: "02:00"}, false},
+		{"negative bandwidth", ScheduleWindow{From: "01:00", To: "02:00", Bandwidth: -1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.window.Validate(); (err == nil) != test.valid {
+				t.Fatalf("got %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
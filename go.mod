@@ -3,3 +3,7 @@ module github.com/arun-kushwaha04/DownloadHub
 go 1.22.5
 
 require github.com/google/uuid v1.6.0
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require golang.org/x/sys v0.30.0
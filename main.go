@@ -1,23 +1,36 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
-	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/api"
+	"github.com/arun-kushwaha04/DownloadHub/configs"
 	"github.com/arun-kushwaha04/DownloadHub/service"
 )
 
 func main() {
-	const url = "https://in.mirror.coganng.com/ubuntu-cdimage/24.04/ubuntu-24.04-desktop-amd64.iso"
+	configPath := flag.String("config", "", "path of the yaml config file")
+	flag.Parse()
 
-	highPtr := &pkg.DownloadType{MaxThreadCount: 10}
-
-	downloader, err := service.CreateDownloader(url, highPtr)
+	config, err := configs.Load(*configPath)
 	if err != nil {
-		fmt.Println("Unable to create download struct", err)
+		fmt.Println("Invalid configuration", err)
+		os.Exit(-1)
+	}
+	configs.Set(config)
+
+	manager := service.NewManager()
+
+	// downloads interrupted by a crash or restart are resumed first
+	if err := manager.Restore(); err != nil {
+		fmt.Println("Unable to restore downloads", err)
+	}
+
+	server := api.NewServer(manager)
+	if err := server.ListenAndServe(configs.Get().ServerAddress); err != nil {
+		fmt.Println("Server stopped", err)
 		os.Exit(-1)
 	}
-	downloader.StartDownload()
-	fmt.Println("Download completed")
 }
@@ -2,4 +2,12 @@ package pkg
 
 type DownloadSpeed interface {
 	GetMaxThreads() uint8
+	GetPriority() DownloadPriority
+	GetChecksum() *Checksum
+	GetMirrors() []string
+	GetPieces() *Pieces
+	GetBandwidth() float64
+	GetHeaders() map[string]string
+	GetFileName() string
+	GetDirectory() string
 }
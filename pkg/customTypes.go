@@ -1,59 +1,337 @@
 package pkg
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
+type DownloadPriority int8
+
+const (
+	LowPriority DownloadPriority = iota - 1
+	NormalPriority
+	HighPriority
+)
+
+func (priority DownloadPriority) String() string {
+	switch priority {
+	case LowPriority:
+		return "low"
+	case NormalPriority:
+		return "normal"
+	case HighPriority:
+		return "high"
+	}
+	return "unknown"
+}
+
+func (priority DownloadPriority) MarshalText() ([]byte, error) {
+	return []byte(priority.String()), nil
+}
+
+func (priority *DownloadPriority) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "low":
+		*priority = LowPriority
+	case "normal", "":
+		*priority = NormalPriority
+	case "high":
+		*priority = HighPriority
+	default:
+		return fmt.Errorf("invalid priority %q", text)
+	}
+	return nil
+}
+
+// Weight is the share of connections and bandwidth a download gets compared
+// to the other running downloads
+func (priority DownloadPriority) Weight() int {
+	return 1 << (priority - LowPriority)
+}
+
+// Checksum is the expected digest of a file, in text it is written as
+// "<algorithm>:<hex digest>" for example "sha256:9f86d0..."
+type Checksum struct {
+	Algorithm string // one of md5, sha1, sha256, sha512
+	Value     []byte
+}
+
+func (checksum Checksum) String() string {
+	return checksum.Algorithm + ":" + hex.EncodeToString(checksum.Value)
+}
+
+func (checksum Checksum) MarshalText() ([]byte, error) {
+	return []byte(checksum.String()), nil
+}
+
+func (checksum *Checksum) UnmarshalText(text []byte) error {
+	algorithm, value, found := strings.Cut(string(text), ":")
+	if !found {
+		return fmt.Errorf("invalid checksum %q, expected <algorithm>:<hex digest>", text)
+	}
+	algorithm = strings.ToLower(algorithm)
+	size, ok := ChecksumSizes[algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	digest, err := hex.DecodeString(value)
+	if err != nil || len(digest) != size {
+		return fmt.Errorf("invalid %s digest %q", algorithm, value)
+	}
+	checksum.Algorithm = algorithm
+	checksum.Value = digest
+	return nil
+}
+
+// ChecksumSizes maps the supported algorithms to their digest size in bytes
+var ChecksumSizes = map[string]int{
+	"md5":    16,
+	"sha1":   20,
+	"sha256": 32,
+	"sha512": 64,
+}
+
+// Pieces are the digests of consecutive parts of a file, every part is Length
+// bytes long except the last one
+type Pieces struct {
+	Algorithm string   `json:"algorithm"`
+	Length    int64    `json:"length"`
+	Hashes    [][]byte `json:"hashes"`
+}
+
+// Count returns the number of pieces a file of the given size is split into
+func (pieces *Pieces) Count(fileSize int64) int64 {
+	return (fileSize + pieces.Length - 1) / pieces.Length
+}
+
 type DownloadType struct {
-	MaxThreadCount uint8
+	MaxThreadCount uint8             `json:"maxThreadCount"`
+	Priority       DownloadPriority  `json:"priority"`
+	Checksum       *Checksum         `json:"checksum,omitempty"`
+	Mirrors        []string          `json:"mirrors,omitempty"` // other urls serving the same file
+	Pieces         *Pieces           `json:"pieces,omitempty"`
+	Bandwidth      float64           `json:"bandwidth,omitempty"` // bytes per second, 0 is unlimited
+	Headers        map[string]string `json:"headers,omitempty"`   // sent with the requests to the host of the download url
+	FileName       string            `json:"fileName,omitempty"`  // replaces the name given by the server
+	// Directory replaces the category folder, only library users set it so
+	// api clients can not write outside of the download directory
+	Directory string `json:"-"`
 }
 
 func (t *DownloadType) GetMaxThreads() uint8 {
 	return t.MaxThreadCount
 }
 
+func (t *DownloadType) GetPriority() DownloadPriority {
+	return t.Priority
+}
+
+func (t *DownloadType) GetChecksum() *Checksum {
+	return t.Checksum
+}
+
+func (t *DownloadType) GetMirrors() []string {
+	return t.Mirrors
+}
+
+func (t *DownloadType) GetPieces() *Pieces {
+	return t.Pieces
+}
+
+func (t *DownloadType) GetBandwidth() float64 {
+	return t.Bandwidth
+}
+
+func (t *DownloadType) GetHeaders() map[string]string {
+	return t.Headers
+}
+
+func (t *DownloadType) GetFileName() string {
+	return t.FileName
+}
+
+func (t *DownloadType) GetDirectory() string {
+	return t.Directory
+}
+
+// BandwidthLimits are the limits shared by all downloads in bytes per second,
+// 0 is unlimited. PerHost applies to every host not listed in Hosts.
+// Scheduled is the global limit of the open schedule window, it is read only.
+type BandwidthLimits struct {
+	Global    float64            `json:"global"`
+	PerHost   float64            `json:"perHost"`
+	Hosts     map[string]float64 `json:"hosts,omitempty"`
+	Scheduled *float64           `json:"scheduled,omitempty"`
+}
+
+// DownloadStatus is the state of a download. A download is Queued until a
+// slot is free, Probing while its checksum is looked up, Downloading, then
+// Merging its segments and Completed. Failed, Cancelled and ChecksumMismatch
+// are final, Verifying checks a finished download again.
+type DownloadStatus uint8
+
+const (
+	Queued DownloadStatus = iota
+	Downloading
+	Paused
+	Cancelled
+	Completed
+	Failed
+	ChecksumMismatch
+	Verifying
+	Probing
+	Merging
+)
+
+func (status DownloadStatus) String() string {
+	switch status {
+	case Queued:
+		return "Queued"
+	case Downloading:
+		return "Downloading"
+	case Paused:
+		return "Paused"
+	case Cancelled:
+		return "Cancelled"
+	case Completed:
+		return "Completed"
+	case Failed:
+		return "Failed"
+	case ChecksumMismatch:
+		return "ChecksumMismatch"
+	case Verifying:
+		return "Verifying"
+	case Probing:
+		return "Probing"
+	case Merging:
+		return "Merging"
+	}
+	return "Unknown"
+}
+
+func (status DownloadStatus) MarshalText() ([]byte, error) {
+	return []byte(status.String()), nil
+}
+
+// UnknownFileSize is the size of a resource sent without a Content-Length
+const UnknownFileSize int64 = -1
+
 type ResourceInfo struct {
-	FileSize   int64
-	FileName   string
-	Url        *url.URL
-	Resumeable bool
+	FileSize    int64 // UnknownFileSize until the whole resource is downloaded
+	FileName    string
+	Url         *url.URL
+	FinalUrl    *url.URL // url left after following redirects
+	Resumeable  bool
+	ETag        string
+	ContentType string
+	Mirrors     []*url.URL   // final urls of the mirrors agreeing with the resource
+	Checksum    *Checksum    // digest published by the server
+	Client      *http.Client // holds the connection opened while reading the metadata
 }
 
+// DownloadInfo is a snapshot of a download returned to api clients
+type DownloadInfo struct {
+	DownloaderId string           `json:"id"`
+	Url          string           `json:"url"`
+	FileName     string           `json:"fileName"`
+	FileSize     int64            `json:"fileSize"`
+	FullPath     string           `json:"fullPath"`
+	Status       DownloadStatus   `json:"status"`
+	Priority     DownloadPriority `json:"priority"`
+	Checksum     *Checksum        `json:"checksum,omitempty"`
+	Mirrors      []string         `json:"mirrors,omitempty"`
+	Threads      int              `json:"threads"`   // threads each segment runs
+	Bandwidth    float64          `json:"bandwidth"` // limit set for the download, 0 is unlimited
+	Error        string           `json:"error,omitempty"`
+	ErrorDetails *ErrorDetails    `json:"errorDetails,omitempty"`
+	Stats        DownloadStats    `json:"stats"`
+}
+
+// ErrorDetails tells api clients where a download failed
+type ErrorDetails struct {
+	Kind       string    `json:"kind"` // such as "Server responsed with non 200 status"
+	Segment    *int64    `json:"segment,omitempty"`
+	Thread     *int      `json:"thread,omitempty"`
+	Range      *[2]int64 `json:"range,omitempty"` // [start, end)
+	StatusCode int       `json:"statusCode,omitempty"`
+	Cause      string    `json:"cause,omitempty"` // error the kind was caused by
+}
+
+// DownloadStats is a snapshot of the progress of a download, a new snapshot
+// is taken every stats interval and a snapshot never changes once taken
 type DownloadStats struct {
-	downloadSpeed         *float64 //bytes per second
-	diskWriteSpeed        *float64 //bytes per second
-	memoryUsed            *uint64  //bytes
-	elapsedTime           *time.Duration
-	estimateRemainingTime *time.Duration
-	progress              *float32
-	consistentProgress    *float32
+	downloadSpeed         float64 //bytes per second
+	diskWriteSpeed        float64 //bytes per second
+	memoryUsed            uint64  //bytes
+	elapsedTime           time.Duration
+	estimateRemainingTime time.Duration
+	progress              float32
+	consistentProgress    float32
+	bytesDownloaded       int64
 }
 
 func (downloadStat DownloadStats) GetDownloadSpeed() float64 {
-	return *downloadStat.downloadSpeed
+	return downloadStat.downloadSpeed
+}
+
+func (downloadStat DownloadStats) GetDiskWriteSpeed() float64 {
+	return downloadStat.diskWriteSpeed
+}
+
+func (downloadStat DownloadStats) GetMemoryUsed() uint64 {
+	return downloadStat.memoryUsed
 }
 
-func NewDownloadStats() *DownloadStats {
-	downloadStat := new(DownloadStats)
-	var ds, dw float64 = 0, 0
-	var m uint64 = 0
-	var p, cp float32 = 0, 0
-	et := 0 * time.Second
-	est := 0 * time.Second
+func (downloadStat DownloadStats) GetElapsedTime() time.Duration {
+	return downloadStat.elapsedTime
+}
+
+func (downloadStat DownloadStats) GetEstimateRemainingTime() time.Duration {
+	return downloadStat.estimateRemainingTime
+}
+
+// GetProgress returns the downloaded percentage, 0 while the size is unknown
+func (downloadStat DownloadStats) GetProgress() float32 {
+	return downloadStat.progress
+}
+
+// GetConsistentProgress returns the percentage of completed segments
+func (downloadStat DownloadStats) GetConsistentProgress() float32 {
+	return downloadStat.consistentProgress
+}
 
-	downloadStat.downloadSpeed = &ds
-	downloadStat.diskWriteSpeed = &dw
-	downloadStat.memoryUsed = &m
-	downloadStat.elapsedTime = &et
-	downloadStat.estimateRemainingTime = &est
-	downloadStat.progress = &p
-	downloadStat.consistentProgress = &cp
+func (downloadStat DownloadStats) GetBytesDownloaded() int64 {
+	return downloadStat.bytesDownloaded
+}
 
-	return downloadStat
+func (downloadStat DownloadStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		DownloadSpeed         float64 `json:"downloadSpeed"`
+		DiskWriteSpeed        float64 `json:"diskWriteSpeed"`
+		MemoryUsed            uint64  `json:"memoryUsed"`
+		ElapsedTime           float64 `json:"elapsedTime"`
+		EstimateRemainingTime float64 `json:"estimateRemainingTime"`
+		Progress              float32 `json:"progress"`
+		ConsistentProgress    float32 `json:"consistentProgress"`
+		BytesDownloaded       int64   `json:"bytesDownloaded"`
+	}{
+		DownloadSpeed:         downloadStat.downloadSpeed,
+		DiskWriteSpeed:        downloadStat.diskWriteSpeed,
+		MemoryUsed:            downloadStat.memoryUsed,
+		ElapsedTime:           downloadStat.elapsedTime.Seconds(),
+		EstimateRemainingTime: downloadStat.estimateRemainingTime.Seconds(),
+		Progress:              downloadStat.progress,
+		ConsistentProgress:    downloadStat.consistentProgress,
+		BytesDownloaded:       downloadStat.bytesDownloaded,
+	})
 }
 
-func (downloadStat *DownloadStats) UpdateDownloadStats(
+func NewDownloadStats(
 	ds float64,
 	dWs float64,
 	m uint64,
@@ -61,12 +339,16 @@ func (downloadStat *DownloadStats) UpdateDownloadStats(
 	eRt time.Duration,
 	p float32,
 	cp float32,
-) {
-	*downloadStat.downloadSpeed = ds
-	*downloadStat.diskWriteSpeed = dWs
-	*downloadStat.memoryUsed = m
-	*downloadStat.elapsedTime = t
-	*downloadStat.estimateRemainingTime = eRt
-	*downloadStat.progress = p
-	*downloadStat.consistentProgress = cp
+	bd int64,
+) DownloadStats {
+	return DownloadStats{
+		downloadSpeed:         ds,
+		diskWriteSpeed:        dWs,
+		memoryUsed:            m,
+		elapsedTime:           t,
+		estimateRemainingTime: eRt,
+		progress:              p,
+		consistentProgress:    cp,
+		bytesDownloaded:       bd,
+	}
 }
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+)
+
+// a limited reader reads at most this many bytes at once so the wait after a
+// read stays short
+const maxLimitedRead = 32 * 1024
+
+// seconds of its rate a bucket holds when it has not been used for a while
+const burstTime = 0.25
+
+// rateLimiter is a token bucket refilled with rate bytes per second, a rate
+// of 0 is unlimited. Bytes are taken after they are read so the bucket may go
+// into debt, the reader then waits until the debt is paid back.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	mutex  *sync.Mutex
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{
+		rate:  max(rate, 0),
+		last:  time.Now(),
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (limiter *rateLimiter) setRate(rate float64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.refill()
+	limiter.rate = max(rate, 0)
+	limiter.tokens = min(limiter.tokens, limiter.rate*burstTime)
+}
+
+func (limiter *rateLimiter) getRate() float64 {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.rate
+}
+
+// refill adds the tokens earned since the last call, mutex must be held
+func (limiter *rateLimiter) refill() {
+	now := time.Now()
+	limiter.tokens = min(limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate, limiter.rate*burstTime)
+	limiter.last = now
+}
+
+// take removes n tokens and returns how long the reader has to wait
+func (limiter *rateLimiter) take(n int) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if limiter.rate == 0 {
+		return 0
+	}
+	limiter.refill()
+	limiter.tokens -= float64(n)
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
+
+// limitedReader takes every byte read from all of its limiters, the read
+// waits for the slowest of them. The wait ends early once stopped is closed.
+type limitedReader struct {
+	reader   io.Reader
+	limiters []*rateLimiter
+	stopped  chan struct{}
+}
+
+func newLimitedReader(reader io.Reader, limiters []*rateLimiter, stopped chan struct{}) *limitedReader {
+	return &limitedReader{reader: reader, limiters: limiters, stopped: stopped}
+}
+
+func (reader *limitedReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p[:min(len(p), maxLimitedRead)])
+	if n == 0 {
+		return n, err
+	}
+	var wait time.Duration
+	for _, limiter := range reader.limiters {
+		wait = max(wait, limiter.take(n))
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-reader.stopped:
+		}
+	}
+	return n, err
+}
+
+// bandwidth holds the limits shared by the downloads of a manager, the global
+// limit and one limit per remote host. A host without its own limit gets the
+// default host limit. An open schedule window replaces the global limit until
+// it closes.
+type bandwidth struct {
+	global     *rateLimiter
+	globalRate float64  // global limit outside of schedule windows
+	scheduled  *float64 // global limit of the open schedule window
+	hostRate   float64
+	hostRates  map[string]float64
+	hosts      map[string]*rateLimiter
+	mutex      *sync.Mutex
+}
+
+func newBandwidth(limits pkg.BandwidthLimits) *bandwidth {
+	bandwidth := &bandwidth{
+		global: newRateLimiter(0),
+		hosts:  make(map[string]*rateLimiter),
+		mutex:  &sync.Mutex{},
+	}
+	bandwidth.setLimits(limits)
+	return bandwidth
+}
+
+// host returns the limiter of a host, it is created on first use
+func (bandwidth *bandwidth) host(hostname string) *rateLimiter {
+	bandwidth.mutex.Lock()
+	defer bandwidth.mutex.Unlock()
+	limiter, ok := bandwidth.hosts[hostname]
+	if !ok {
+		limiter = newRateLimiter(bandwidth.getHostRate(hostname))
+		bandwidth.hosts[hostname] = limiter
+	}
+	return limiter
+}
+
+// getHostRate returns the limit of a host, mutex must be held
+func (bandwidth *bandwidth) getHostRate(hostname string) float64 {
+	if rate, ok := bandwidth.hostRates[hostname]; ok {
+		return rate
+	}
+	return bandwidth.hostRate
+}
+
+// setLimits replaces every limit, running downloads follow the new limits
+// with their next read
+func (bandwidth *bandwidth) setLimits(limits pkg.BandwidthLimits) {
+	bandwidth.mutex.Lock()
+	defer bandwidth.mutex.Unlock()
+	bandwidth.globalRate = limits.Global
+	bandwidth.updateGlobal()
+	bandwidth.hostRate = limits.PerHost
+	bandwidth.hostRates = make(map[string]float64)
+	for hostname, rate := range limits.Hosts {
+		bandwidth.hostRates[hostname] = rate
+	}
+	for hostname, limiter := range bandwidth.hosts {
+		limiter.setRate(bandwidth.getHostRate(hostname))
+	}
+}
+
+func (bandwidth *bandwidth) getLimits() pkg.BandwidthLimits {
+	bandwidth.mutex.Lock()
+	defer bandwidth.mutex.Unlock()
+	limits := pkg.BandwidthLimits{
+		Global:    bandwidth.globalRate,
+		PerHost:   bandwidth.hostRate,
+		Hosts:     make(map[string]float64),
+		Scheduled: bandwidth.scheduled,
+	}
+	for hostname, rate := range bandwidth.hostRates {
+		limits.Hosts[hostname] = rate
+	}
+	return limits
+}
+
+// setScheduled replaces the global limit while a schedule window is open, nil
+// restores the limit set outside of windows
+func (bandwidth *bandwidth) setScheduled(rate *float64) {
+	bandwidth.mutex.Lock()
+	defer bandwidth.mutex.Unlock()
+	bandwidth.scheduled = rate
+	bandwidth.updateGlobal()
+}
+
+// updateGlobal applies the limit in effect to the global limiter, mutex must be held
+func (bandwidth *bandwidth) updateGlobal() {
+	rate := bandwidth.globalRate
+	if bandwidth.scheduled != nil {
+		rate = *bandwidth.scheduled
+	}
+	bandwidth.global.setRate(rate)
+}
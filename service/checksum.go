@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/arun-kushwaha04/DownloadHub/configs"
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// checksumState hashes the file in order while it downloads, bytes are fed
+// to the hash as soon as every byte before them is downloaded so the digest
+// is ready when the last segment finishes
+type checksumState struct {
+	expected     *pkg.Checksum
+	hasher       hash.Hash
+	hashedOffset int64
+	mutex        *sync.Mutex
+}
+
+func newChecksumState(expected *pkg.Checksum) *checksumState {
+	return &checksumState{
+		expected: expected,
+		hasher:   utils.NewHash(expected.Algorithm),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// findChecksum uses the checksum given by the caller, then the one sent by
+// the server and at last looks for a published checksum file
+func (downloader *downloader) findChecksum() {
+	if downloader.checksum.Load() != nil {
+		return
+	}
+	checksum := downloader.downloadPrt.GetChecksum()
+	if checksum == nil {
+		checksum = downloader.resourceInfo.Checksum
+	}
+	if checksum == nil {
+		// checksum files are published next to the file the redirects led to
+		checksumUrl := downloader.GetDownloadUrl()
+		checksum = utils.FindChecksum(downloader.ctx, checksumUrl, downloader.resourceInfo.FileName, downloader.headersFor(checksumUrl))
+	}
+	if checksum != nil {
+		fmt.Println("Verifying download with", checksum.Algorithm, "checksum")
+		downloader.checksum.Store(newChecksumState(checksum))
+	}
+}
+
+func (downloader *downloader) GetChecksum() *pkg.Checksum {
+	state := downloader.checksum.Load()
+	if state == nil {
+		return downloader.downloadPrt.GetChecksum()
+	}
+	return state.expected
+}
+
+// completedPrefix returns the end of the downloaded bytes which follow offset
+// without a gap
+func (downloader *downloader) completedPrefix(offset int64) int64 {
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+
+	for offset < downloader.resourceInfo.FileSize {
+		segmentId := offset / downloader.segmentSize
+		segmentEnd := min((segmentId+1)*downloader.segmentSize, downloader.resourceInfo.FileSize)
+		if downloader.finishedSegments[segmentId] {
+			offset = segmentEnd
+			continue
+		}
+
+		if downloader.pieces != nil {
+			// bytes of a segment are hashed only once its pieces are verified
+			break
+		}
+		chunks := downloader.segmentProgress[segmentId]
+		if segment, ok := downloader.activeSegments[segmentId]; ok {
+			chunks = segment.getCompletedChunks()
+		}
+		for _, chunk := range chunks {
+			if chunk[0] <= offset && offset < chunk[1] {
+				offset = chunk[1]
+			}
+		}
+		if offset < segmentEnd {
+			break
+		}
+	}
+	return offset
+}
+
+// updateChecksum hashes the bytes downloaded since the last update
+func (downloader *downloader) updateChecksum() error {
+	// a repaired file is hashed once it is merged
+	state := downloader.checksum.Load()
+	if state == nil || downloader.isRepairing() {
+		return nil
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	end := downloader.completedPrefix(state.hashedOffset)
+	tempFolder := path.Join(configs.Get().TempDirectory, downloader.downloaderId.String())
+	for state.hashedOffset < end {
+		// bytes written directly are read from the file itself
+		filePath := downloader.fullPath
+		var fileStart int64 // offset of the first byte of the file
+		readEnd := end
+		if !downloader.directWrite {
+			segmentId := state.hashedOffset / downloader.segmentSize
+			fileStart = segmentId * downloader.segmentSize
+			readEnd = min(fileStart+downloader.segmentSize, end)
+			filePath = path.Join(tempFolder, strconv.FormatInt(segmentId, 10)+configs.SEG_EXT)
+		}
+
+		file, err := os.Open(filePath)
+		if os.IsNotExist(err) && !downloader.directWrite {
+			// the segment was merged into the file before a restart
+			fileStart = 0
+			file, err = os.Open(downloader.fullPath)
+		}
+		if err != nil {
+			return utils.NewError(utils.MissingSegmentFile, err)
+		}
+		length := readEnd - state.hashedOffset
+		n, err := io.Copy(state.hasher, io.NewSectionReader(file, state.hashedOffset-fileStart, length))
+		file.Close()
+		state.hashedOffset += n
+		if err != nil {
+			return utils.NewError(utils.FileReadPermissionError, err)
+		}
+		if n < length {
+			// segment file is shorter than its recorded progress
+			return utils.MissingSegmentFile
+		}
+	}
+	return nil
+}
+
+// verifyChecksum finishes hashing the file and compares it with the expected digest
+func (downloader *downloader) verifyChecksum() error {
+	if downloader.checksum.Load() == nil {
+		return nil
+	}
+	if err := downloader.updateChecksum(); err != nil {
+		return err
+	}
+	return downloader.compareChecksum()
+}
+
+func (downloader *downloader) compareChecksum() error {
+	state := downloader.checksum.Load()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.hashedOffset != downloader.resourceInfo.FileSize || !bytes.Equal(state.hasher.Sum(nil), state.expected.Value) {
+		return utils.ChecksumMismatch
+	}
+	return nil
+}
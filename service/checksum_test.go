@@ -0,0 +1,128 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+)
+
+// pollInfo reads the info of the download until stop is closed, run with
+// -race it catches fields written without the lock GetInfo takes
+func pollInfo(download *Download, stop chan struct{}) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			download.Info()
+			download.Stats()
+		}
+	}()
+	return done
+}
+
+func TestInfoDuringDownloadAndVerify(t *testing.T) {
+	setTestConfig(t)
+	data := randomData(t, 4*1024*1024)
+	server := newTestServer(t, data)
+	sum := sha256.Sum256(data)
+
+	client := NewClient()
+	download, err := client.NewDownload(server.URL+"/file.bin", WithChecksum("sha256:"+hex.EncodeToString(sum[:])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	polled := pollInfo(download, stop)
+	err = download.Wait()
+	close(stop)
+	<-polled
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupt byte makes the verify download its segment again
+	info, _ := download.Info()
+	file, err := os.OpenFile(info.FullPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{^data[1000]}, 1000); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	stop = make(chan struct{})
+	polled = pollInfo(download, stop)
+	defer func() {
+		close(stop)
+		<-polled
+	}()
+	if err := client.manager.Verify(download.downloader.downloaderId); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		info, _ = download.Info()
+		if info.Status == pkg.Completed || info.Status == pkg.Failed || info.Status == pkg.ChecksumMismatch {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("verify did not finish, status %s", info.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.Status != pkg.Completed {
+		t.Fatalf("status %s after verify", info.Status)
+	}
+	if info.Checksum == nil || info.Checksum.Algorithm != "sha256" {
+		t.Fatalf("checksum %v", info.Checksum)
+	}
+}
+
+func TestChecksumFoundAfterRedirect(t *testing.T) {
+	setTestConfig(t)
+	data := randomData(t, 1024*1024)
+	sum := sha256.Sum256(data)
+
+	mux := http.NewServeMux()
+	mux.Handle("/download", http.RedirectHandler("/files/file.bin", http.StatusFound))
+	mux.HandleFunc("/files/file.bin", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	})
+	mux.HandleFunc("/files/file.bin.sha256", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(hex.EncodeToString(sum[:]) + "  file.bin\n"))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	download, err := NewClient().NewDownload(server.URL + "/download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := download.Info()
+	if info.Checksum == nil || !bytes.Equal(info.Checksum.Value, sum[:]) {
+		t.Fatalf("checksum next to the redirected file was not used: %v", info.Checksum)
+	}
+}
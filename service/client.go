@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// Client downloads files from inside another go program. Its downloads share
+// a queue and the connection and bandwidth limits like the downloads of the
+// server, every setting not given as an option is read from the config set
+// with configs.Set.
+type Client struct {
+	manager *Manager
+	options []Option // applied to every download before its own options
+}
+
+// Option changes a download made by a client
+type Option func(*downloadOptions)
+
+type downloadOptions struct {
+	downloadType pkg.DownloadType
+	checksum     string
+	progress     func(pkg.DownloadStats)
+}
+
+// WithDirectory saves the file in directory instead of its category folder
+func WithDirectory(directory string) Option {
+	return func(options *downloadOptions) {
+		options.downloadType.Directory = directory
+	}
+}
+
+// WithFileName saves the file under fileName instead of the name given by the server
+func WithFileName(fileName string) Option {
+	return func(options *downloadOptions) {
+		options.downloadType.FileName = fileName
+	}
+}
+
+// WithHeader sends the header with the requests of the download made to the
+// host of its url, mirrors and other hosts do not get it. Credential headers
+// such as Authorization are not written to the journal, a download sending
+// them is dropped with its partial file instead of being restored after a
+// restart.
+func WithHeader(key string, value string) Option {
+	return func(options *downloadOptions) {
+		if options.downloadType.Headers == nil {
+			options.downloadType.Headers = make(map[string]string)
+		}
+		options.downloadType.Headers[key] = value
+	}
+}
+
+// WithThreads is the most threads a segment runs
+func WithThreads(maxThreads uint8) Option {
+	return func(options *downloadOptions) {
+		options.downloadType.MaxThreadCount = maxThreads
+	}
+}
+
+// WithSpeedLimit limits the download to bytes per second, 0 is unlimited
+func WithSpeedLimit(bandwidth float64) Option {
+	return func(options *downloadOptions) {
+		options.downloadType.Bandwidth = bandwidth
+	}
+}
+
+// WithChecksum verifies the file with a checksum such as "sha256:<hex digest>"
+func WithChecksum(checksum string) Option {
+	return func(options *downloadOptions) {
+		options.checksum = checksum
+	}
+}
+
+// WithPriority sets the share of connections and bandwidth the download gets
+func WithPriority(priority pkg.DownloadPriority) Option {
+	return func(options *downloadOptions) {
+		options.downloadType.Priority = priority
+	}
+}
+
+// WithMirrors downloads the file from the mirrors as well
+func WithMirrors(mirrors ...string) Option {
+	return func(options *downloadOptions) {
+		options.downloadType.Mirrors = append(options.downloadType.Mirrors, mirrors...)
+	}
+}
+
+// WithProgress calls progress with the stats of the download every second,
+// it must return quickly as the download waits for it
+func WithProgress(progress func(pkg.DownloadStats)) Option {
+	return func(options *downloadOptions) {
+		options.progress = progress
+	}
+}
+
+// NewClient creates a client, the options are the defaults of its downloads
+func NewClient(options ...Option) *Client {
+	return &Client{
+		manager: NewManager(),
+		options: options,
+	}
+}
+
+// Close cancels the downloads of the client which have not ended, waits for
+// them and stops the client, the client must not be used afterwards
+func (client *Client) Close() {
+	for _, downloader := range client.manager.List() {
+		if err := client.manager.Cancel(downloader.downloaderId); err == nil {
+			fmt.Println("Download", downloader.downloaderId, "cancelled by closing the client")
+		}
+		<-downloader.doneChan()
+	}
+	client.manager.Close()
+}
+
+// NewDownload prepares a download of resourceUrl, nothing is requested
+// before Start
+func (client *Client) NewDownload(resourceUrl string, options ...Option) (*Download, error) {
+	download := &Download{
+		client: client,
+		url:    resourceUrl,
+		mutex:  &sync.Mutex{},
+	}
+	for _, option := range slices.Concat(client.options, options) {
+		option(&download.options)
+	}
+	if download.options.checksum != "" {
+		checksum := &pkg.Checksum{}
+		if err := checksum.UnmarshalText([]byte(download.options.checksum)); err != nil {
+			return nil, err
+		}
+		download.options.downloadType.Checksum = checksum
+	}
+	return download, nil
+}
+
+// Download is a download made by a client
+type Download struct {
+	client     *Client
+	url        string
+	options    downloadOptions
+	ctx        context.Context
+	downloader *downloader
+	mutex      *sync.Mutex
+}
+
+// Start probes the resource and queues the download, it returns once the
+// download is queued. The download is cancelled when ctx is done before it
+// finished.
+func (download *Download) Start(ctx context.Context) error {
+	download.mutex.Lock()
+	defer download.mutex.Unlock()
+
+	if download.downloader != nil {
+		return utils.DownloadAlreadyStarted
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	downloader, err := CreateDownloader(ctx, download.url, &download.options.downloadType)
+	if err != nil {
+		return err
+	}
+	downloader.progress = download.options.progress
+	download.ctx = ctx
+	download.downloader = downloader
+
+	manager := download.client.manager
+	manager.add(downloader)
+	stop := context.AfterFunc(ctx, func() {
+		if err := manager.Cancel(downloader.downloaderId); err == nil {
+			fmt.Println("Download", downloader.downloaderId, "cancelled by its context")
+		}
+	})
+	go func() {
+		<-downloader.doneChan()
+		stop()
+	}()
+	return nil
+}
+
+// Wait blocks until the download ended, it returns nil once the file is
+// complete. A failed download returns a *utils.DownloadError and a download
+// cancelled by the context of Start returns its cause.
+func (download *Download) Wait() error {
+	downloader, err := download.getDownloader()
+	if err != nil {
+		return err
+	}
+	<-downloader.doneChan()
+
+	switch downloader.GetStatus() {
+	case pkg.Completed:
+		return nil
+	case pkg.Cancelled:
+		if download.ctx.Err() != nil {
+			return context.Cause(download.ctx)
+		}
+		return utils.DownloadCancelled
+	}
+	return downloader.getError()
+}
+
+// Pause stops the download until Resume is called
+func (download *Download) Pause() error {
+	downloader, err := download.getDownloader()
+	if err != nil {
+		return err
+	}
+	return download.client.manager.Pause(downloader.downloaderId)
+}
+
+func (download *Download) Resume() error {
+	downloader, err := download.getDownloader()
+	if err != nil {
+		return err
+	}
+	return download.client.manager.Resume(downloader.downloaderId)
+}
+
+// Cancel stops the download and removes its partial files
+func (download *Download) Cancel() error {
+	downloader, err := download.getDownloader()
+	if err != nil {
+		return err
+	}
+	return download.client.manager.Cancel(downloader.downloaderId)
+}
+
+// Info returns a snapshot of the download, it fails before Start
+func (download *Download) Info() (pkg.DownloadInfo, error) {
+	downloader, err := download.getDownloader()
+	if err != nil {
+		return pkg.DownloadInfo{}, err
+	}
+	return downloader.GetInfo(), nil
+}
+
+// Stats returns the latest stats snapshot, it is safe to call at any time and
+// returns empty stats before Start
+func (download *Download) Stats() pkg.DownloadStats {
+	downloader, err := download.getDownloader()
+	if err != nil {
+		return pkg.DownloadStats{}
+	}
+	return downloader.Stats()
+}
+
+func (download *Download) getDownloader() (*downloader, error) {
+	download.mutex.Lock()
+	defer download.mutex.Unlock()
+	if download.downloader == nil {
+		return nil, utils.DownloadNotRunning
+	}
+	return download.downloader, nil
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+func TestStartEndsProbeWithContext(t *testing.T) {
+	setTestConfig(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	download, err := NewClient().NewDownload(server.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	if err := download.Start(ctx); err == nil {
+		t.Fatal("start succeeded without an answer from the server")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("start returned after %s", elapsed)
+	}
+}
+
+// headerServer serves data and records the Authorization headers it received
+type headerServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	headers []string
+}
+
+func newHeaderServer(t *testing.T, data []byte) *headerServer {
+	t.Helper()
+	server := &headerServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		server.headers = append(server.headers, r.Header.Get("Authorization"))
+		server.mutex.Unlock()
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (server *headerServer) received() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string(nil), server.headers...)
+}
+
+func TestHeadersOnlySentToOrigin(t *testing.T) {
+	setTestConfig(t)
+	data := randomData(t, 4*1024*1024)
+	origin := newHeaderServer(t, data)
+	mirror := newHeaderServer(t, data)
+
+	download, err := NewClient().NewDownload(origin.URL+"/file.bin",
+		WithHeader("Authorization", "Bearer secret"),
+		WithHeader("X-Trace", "1"),
+		WithMirrors(mirror.URL+"/file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range origin.received() {
+		if header != "Bearer secret" {
+			t.Fatalf("origin got Authorization %q", header)
+		}
+	}
+	if len(mirror.received()) == 0 {
+		t.Fatal("mirror was never asked")
+	}
+	for _, header := range mirror.received() {
+		if header != "" {
+			t.Fatalf("mirror got Authorization %q", header)
+		}
+	}
+
+	journalHeader := download.downloader.getJournalHeader()
+	if _, ok := journalHeader.Headers["Authorization"]; ok {
+		t.Fatal("Authorization was written to the journal")
+	}
+	if journalHeader.Headers["X-Trace"] != "1" || !journalHeader.CredentialsDropped {
+		t.Fatalf("journal header %+v", journalHeader)
+	}
+}
+
+func TestCloseCancelsDownloads(t *testing.T) {
+	config := setTestConfig(t)
+	config.Bandwidth = 256 * 1024
+	data := randomData(t, 8*1024*1024)
+	server := newTestServer(t, data)
+
+	client := NewClient()
+	download, err := client.NewDownload(server.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := download.Wait(); !errors.Is(err, utils.DownloadCancelled) {
+		t.Fatalf("wait returned %v", err)
+	}
+}
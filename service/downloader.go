@@ -1,15 +1,21 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"slices"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/arun-kushwaha04/DownloadHub/configs"
@@ -19,23 +25,24 @@ import (
 )
 
 type downloader struct {
-	downloaderId  uuid.UUID
-	resourceInfo  *pkg.ResourceInfo
-	downloadStats *pkg.DownloadStats
-	downloadPrt   pkg.DownloadSpeed
-	fullPath      string
+	downloaderId uuid.UUID
+	resourceInfo *pkg.ResourceInfo
+	stats        atomic.Pointer[pkg.DownloadStats] // replaced by a new snapshot every stats update
+	downloadPrt  pkg.DownloadSpeed
+	fullPath     string
 
-	startTime        time.Time
-	runTime          time.Duration
-	writeTime        time.Duration
-	writeTimeChannel chan time.Duration
+	startTime time.Time
+	runTime   time.Duration
 
-	bytesDownloaded    int64
-	bytesWrittenToDisk int64
-	bytesUpdateChannel chan [2]int
+	// counted by the threads without locks, the monitor turns them into stats
+	bytesDownloaded    atomic.Int64
+	bytesWrittenToDisk atomic.Int64
+	writeTime          atomic.Int64 // nanoseconds spent writing to disk
 
-	maxNumberOfSegments int
-	totalSegments       int64
+	segmentSize       int64
+	connectionLimiter *limiter // connections shared by all segments
+	segmentLimiter    *limiter // segments downloading at the same time
+	totalSegments     int64
 
 	activeSegments    map[int64]*Segment
 	completedSegments int64
@@ -45,46 +52,362 @@ type downloader struct {
 	errorChan chan error
 
 	statsUpdateInterval time.Duration
+	journalSyncInterval time.Duration
 	prevDownloadSpeed   float64
 	maxBandwidth        float64
+	limitMutex          *sync.Mutex
 
-	intervalBytesDownload int
-	intervalByteMutex     *sync.Mutex
-	instantDownloadSpeed  float64
+	monitoredBytes       int64 // bytesDownloaded at the last stats update, used by the monitor only
+	instantDownloadSpeed float64
 
-	speedLimited     bool
-	maxDownloadSpeed float64
+	bandwidthLimit float64      // limit set by the caller, 0 is unlimited
+	rateLimiter    *rateLimiter // limits the download to its share and its own limit
+	bandwidth      *bandwidth   // global and host limits of the manager
 
 	lastSyncTime time.Time
 	client       *http.Client
+	ctx          context.Context    // ends the requests made outside the threads
+	stopRequests context.CancelFunc // called once the download is cancelled
+
+	status      pkg.DownloadStatus
+	statusMutex *sync.Mutex
+	controlChan chan uint8
+
+	segmentProgress  map[int64][][2]int64 // downloaded byte ranges of unfinished segments
+	finishedSegments map[int64]bool
+	journal          *journal
+
+	checksum atomic.Pointer[checksumState] // replaced when the checksum is found or a repair starts
+	mirrors  *mirrorSet
+	tuner    *threadTuner
+	pieces   *pkg.Pieces // hashes verifying each segment once it is downloaded
+
+	retryPolicy retryPolicy // how often and how late a failed range is requested again
+
+	progress func(pkg.DownloadStats) // called with the stats every update interval
+	done     chan struct{}           // closed once the download ended
+
+	repairSegments map[int64]bool // corrupt segments downloaded again after a verify
+	err            error          // reason of the failure shown to api clients
+	cause          error          // first error stopping a segment
+
+	singleStream bool // one connection downloads the whole file
+	streaming    bool // size is unknown, the file is read until the server closes the response
+	streamSwitch bool // a server ignored a range request, segments must stop
+	directWrite  bool // threads write into the file at fullPath, there are no segment files
+
+	stream       *http.Response          // whole file sent for a range starting at 0, continued by the single stream
+	cancelStream context.CancelCauseFunc // ends the request of stream
 }
 
+// segments merged into the file at the same time
+const maxMergeWorkers = 4
+
 func (downloader *downloader) addSegement(segment *Segment) {
 	downloader.segmentMutex.Lock()
 	downloader.activeSegments[segment.segmentId] = segment
-	downloader.completedSegments++
+	// a pause or cancel may have happened while the segment was being created
+	if downloader.isStopping() {
+		segment.stop(controlPause)
+	}
+	downloader.segmentMutex.Unlock()
+}
+
+// removeSegement records the progress of a segment once all its threads exited
+func (downloader *downloader) removeSegement(segment *Segment) {
+	downloader.segmentMutex.Lock()
+	delete(downloader.activeSegments, segment.segmentId)
+	if segment.isCompleted() {
+		if downloader.streaming {
+			// the size is known once the stream ended
+			downloader.resourceInfo.FileSize = segment.getSegmentEnd()
+		}
+		downloader.finishedSegments[segment.segmentId] = true
+		delete(downloader.segmentProgress, segment.segmentId)
+		downloader.completedSegments++
+	} else {
+		downloader.segmentProgress[segment.segmentId] = segment.getCompletedChunks()
+	}
 	downloader.segmentMutex.Unlock()
 }
 
-func (downloader *downloader) removeSegement(segmentId int64) {
+func (downloader *downloader) getSegmentProgress(segmentId int64) [][2]int64 {
+	// a single stream can not continue from the middle of the file
+	if downloader.isSingleStream() {
+		return nil
+	}
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+	chunks := make([][2]int64, len(downloader.segmentProgress[segmentId]))
+	copy(chunks, downloader.segmentProgress[segmentId])
+	return chunks
+}
+
+// pendingSegments returns the segments which are not completely downloaded
+func (downloader *downloader) pendingSegments() []int64 {
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+	var segments []int64
+	for i := range downloader.totalSegments {
+		if !downloader.finishedSegments[i] {
+			segments = append(segments, i)
+		}
+	}
+	return segments
+}
+
+func (downloader *downloader) GetStatus() pkg.DownloadStatus {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	return downloader.status
+}
+
+func (downloader *downloader) setStatus(status pkg.DownloadStatus) {
+	downloader.statusMutex.Lock()
+	downloader.status = status
+	downloader.statusMutex.Unlock()
+}
+
+// fail marks the download with a final status and keeps the reason, the
+// reason is located in the download. A nil err clears the reason of an
+// earlier failure.
+func (downloader *downloader) fail(status pkg.DownloadStatus, err error) {
+	var reason error
+	if err != nil {
+		downloadErr, ok := err.(*utils.DownloadError)
+		if !ok {
+			downloadErr = utils.NewError(err, nil)
+		}
+		reason = downloadErr.InDownload(downloader.downloaderId)
+	}
+
+	downloader.statusMutex.Lock()
+	downloader.status = status
+	downloader.err = reason
+	downloader.statusMutex.Unlock()
+}
+
+func (downloader *downloader) getError() error {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	return downloader.err
+}
+
+// reportError stops the download with err, the first error becomes the
+// reason of the failure
+func (downloader *downloader) reportError(err error) {
+	downloader.statusMutex.Lock()
+	if downloader.cause == nil {
+		downloader.cause = err
+	}
+	downloader.statusMutex.Unlock()
+	downloader.errorChan <- err
+}
+
+// failureCause returns the error the segments stopped with
+func (downloader *downloader) failureCause() error {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	return utils.NewError(utils.DownloadFailed, downloader.cause)
+}
+
+func (downloader *downloader) getErrorMessage() string {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	if downloader.err == nil {
+		return ""
+	}
+	return downloader.err.Error()
+}
+
+// doneChan returns the channel closed once the current run of the download ended
+func (downloader *downloader) doneChan() chan struct{} {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	return downloader.done
+}
+
+// finish wakes up everyone waiting for the download to end
+func (downloader *downloader) finish() {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	select {
+	case <-downloader.done:
+	default:
+		close(downloader.done)
+	}
+}
+
+func (downloader *downloader) isSwitchingStream() bool {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	return downloader.streamSwitch
+}
+
+func (downloader *downloader) isSingleStream() bool {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	return downloader.singleStream
+}
+
+// isStopping reports whether running segments must stop
+func (downloader *downloader) isStopping() bool {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	return downloader.status != pkg.Downloading || downloader.streamSwitch
+}
+
+// switchToSingleStream is called when a server answers a range request with
+// the whole file, every segment is stopped and StartDownload restarts the
+// download over a single connection
+func (downloader *downloader) switchToSingleStream() {
 	downloader.segmentMutex.Lock()
-	delete(downloader.activeSegments, segmentId)
+	defer downloader.segmentMutex.Unlock()
+
+	downloader.statusMutex.Lock()
+	if downloader.singleStream || downloader.streamSwitch {
+		downloader.statusMutex.Unlock()
+		return
+	}
+	fmt.Println("Server ignored range request, switching to a single connection")
+	downloader.streamSwitch = true
+	downloader.statusMutex.Unlock()
+
+	downloader.closeActiveSegments(controlPause)
+	downloader.segmentLimiter.wake()
+}
+
+// holdStream keeps the response of a range request starting at the beginning
+// of the file which the server answered with the whole file, the single
+// stream continues it instead of requesting the file again
+func (downloader *downloader) holdStream(res *http.Response, cancel context.CancelCauseFunc) {
+	downloader.dropStream()
+	downloader.statusMutex.Lock()
+	downloader.stream = res
+	downloader.cancelStream = cancel
+	downloader.statusMutex.Unlock()
+}
+
+// takeStream hands the held response to the single stream thread starting at
+// the beginning of the file, it returns nil for every other thread
+func (downloader *downloader) takeStream(startByte int64) (*http.Response, context.CancelCauseFunc) {
+	downloader.statusMutex.Lock()
+	defer downloader.statusMutex.Unlock()
+	if !downloader.singleStream || startByte != 0 || downloader.stream == nil {
+		return nil, nil
+	}
+	res, cancel := downloader.stream, downloader.cancelStream
+	downloader.stream, downloader.cancelStream = nil, nil
+	return res, cancel
+}
+
+// dropStream ends a held response no thread continued
+func (downloader *downloader) dropStream() {
+	downloader.statusMutex.Lock()
+	res, cancel := downloader.stream, downloader.cancelStream
+	downloader.stream, downloader.cancelStream = nil, nil
+	downloader.statusMutex.Unlock()
+	if res != nil {
+		cancel(nil)
+		res.Body.Close()
+	}
+}
+
+// resetForSingleStream drops the progress of the ranged segments, which can
+// not be trusted, and makes the whole file a single segment
+func (downloader *downloader) resetForSingleStream() error {
+	if state := downloader.checksum.Load(); state != nil {
+		state.mutex.Lock()
+		state.hasher.Reset()
+		state.hashedOffset = 0
+		defer state.mutex.Unlock()
+	}
+
+	downloader.segmentMutex.Lock()
+	downloader.resourceInfo.Resumeable = false
+	downloader.segmentSize = max(downloader.resourceInfo.FileSize, 1)
+	downloader.totalSegments = getTotalSegments(downloader.resourceInfo.FileSize, downloader.segmentSize)
+	downloader.segmentProgress = make(map[int64][][2]int64)
+	downloader.finishedSegments = make(map[int64]bool)
+	downloader.completedSegments = 0
+	header := downloader.getJournalHeader()
 	downloader.segmentMutex.Unlock()
+
+	downloader.statusMutex.Lock()
+	downloader.singleStream = true
+	downloader.streamSwitch = false
+	downloader.statusMutex.Unlock()
+
+	// old segment files are removed before the new journal is written
+	if err := os.RemoveAll(path.Join(configs.Get().TempDirectory, downloader.downloaderId.String())); err != nil {
+		return utils.NewError(utils.TempDirCreatePermissionError, err)
+	}
+	return downloader.journal.reset(header)
+}
+
+// sendControl wakes up StartDownload when it is waiting for a resume, it never blocks
+func (downloader *downloader) sendControl(signal uint8) {
+	select {
+	case downloader.controlChan <- signal:
+	default:
+	}
+}
+
+// Pause stops all running segments, already downloaded byte ranges are kept
+// and only the missing ranges are requested on resume
+func (downloader *downloader) Pause() error {
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+
+	status := downloader.GetStatus()
+	if status != pkg.Downloading && status != pkg.Queued && status != pkg.Probing {
+		return utils.DownloadNotRunning
+	}
+	downloader.setStatus(pkg.Paused)
+	downloader.closeActiveSegments(controlPause)
+	downloader.segmentLimiter.wake()
+	downloader.dropStream()
+	return nil
+}
+
+func (downloader *downloader) Resume() error {
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+
+	if downloader.GetStatus() != pkg.Paused {
+		return utils.DownloadNotPaused
+	}
+	downloader.setStatus(pkg.Downloading)
+	downloader.sendControl(controlPause)
+	return nil
+}
+
+// Cancel stops the download and removes the segment files along with the
+// partially downloaded file
+func (downloader *downloader) Cancel() error {
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+
+	switch downloader.GetStatus() {
+	case pkg.Cancelled, pkg.Completed, pkg.Failed, pkg.ChecksumMismatch, pkg.Verifying, pkg.Merging:
+		return utils.DownloadAlreadyFinished
+	}
+	downloader.setStatus(pkg.Cancelled)
+	downloader.stopRequests()
+	downloader.dropStream()
+	downloader.closeActiveSegments(controlCancel)
+	downloader.segmentLimiter.wake()
+	downloader.sendControl(controlCancel)
+	return nil
 }
 
 func (downloader *downloader) Intalize(
 	uuid uuid.UUID,
 	resourceInfo *pkg.ResourceInfo,
-	downloadStats *pkg.DownloadStats,
 	downloadPrt pkg.DownloadSpeed,
 	fullPath string,
 
-	writeTime time.Duration,
-	writeTimeChannel chan time.Duration,
-
-	bytesUpdateChannel chan [2]int,
-
-	maxNumberOfSegments int,
+	maxConnections int,
 	totalSegments int64,
 
 	activeSegments map[int64]*Segment,
@@ -96,28 +419,20 @@ func (downloader *downloader) Intalize(
 	statsUpdateInterval time.Duration,
 	maxBandwidth float64,
 
-	intervalByteMutex *sync.Mutex,
-
-	speedLimited bool,
-	maxDownloadSpeed float64,
+	bandwidthLimit float64,
 
 ) {
 	downloader.downloaderId = uuid
 	downloader.resourceInfo = resourceInfo
-	downloader.downloadStats = downloadStats
+	downloader.stats.Store(&pkg.DownloadStats{})
 	downloader.downloadPrt = downloadPrt
 	downloader.fullPath = fullPath
 
 	downloader.startTime = time.Now()
 	downloader.runTime = time.Since(time.Now())
-	downloader.writeTime = time.Duration(0)
-	downloader.writeTimeChannel = writeTimeChannel
-
-	downloader.bytesDownloaded = 0
-	downloader.bytesUpdateChannel = bytesUpdateChannel
-	downloader.bytesWrittenToDisk = 0
 
-	downloader.maxNumberOfSegments = maxNumberOfSegments
+	downloader.connectionLimiter = newLimiter(maxConnections)
+	downloader.segmentLimiter = newLimiter(segmentsForConnections(maxConnections, int(defaultSegmentThreads)))
 	downloader.totalSegments = totalSegments
 
 	downloader.activeSegments = activeSegments
@@ -130,98 +445,180 @@ func (downloader *downloader) Intalize(
 	downloader.statsUpdateInterval = statsUpdateInterval
 	downloader.prevDownloadSpeed = float64(0)
 	downloader.maxBandwidth = maxBandwidth
+	downloader.limitMutex = &sync.Mutex{}
 
-	downloader.intervalBytesDownload = 0
-	downloader.intervalByteMutex = intervalByteMutex
 	downloader.instantDownloadSpeed = float64(0)
 
-	downloader.speedLimited = speedLimited
-	downloader.maxDownloadSpeed = maxDownloadSpeed
+	downloader.bandwidthLimit = bandwidthLimit
+	downloader.rateLimiter = newRateLimiter(0)
+	downloader.updateRate()
 
 	downloader.lastSyncTime = time.Now()
-	downloader.client = &http.Client{}
+	downloader.client = utils.NewHttpClient()
+	downloader.ctx, downloader.stopRequests = context.WithCancel(context.Background())
+
+	downloader.status = pkg.Queued
+	downloader.statusMutex = &sync.Mutex{}
+	downloader.controlChan = make(chan uint8, 1)
+	downloader.done = make(chan struct{})
+
+	downloader.journalSyncInterval = 2 * time.Second
+	downloader.segmentProgress = make(map[int64][][2]int64)
+	downloader.finishedSegments = make(map[int64]bool)
 }
 
-func (downloader downloader) GetDownloadUrl() *url.URL {
+// GetDownloadUrl returns the url the redirects led to so segments do not
+// follow them again
+func (downloader *downloader) GetDownloadUrl() *url.URL {
+	if downloader.resourceInfo.FinalUrl != nil {
+		return downloader.resourceInfo.FinalUrl
+	}
 	return downloader.resourceInfo.Url
 }
 
-func (downloader *downloader) MonitorDownloadResource() {
+// headersFor returns the headers of the download when target is on the host
+// the download was requested from
+func (downloader *downloader) headersFor(target *url.URL) map[string]string {
+	return utils.ScopeHeaders(downloader.downloadPrt.GetHeaders(), downloader.resourceInfo.Url, target)
+}
+
+func (downloader *downloader) GetDownloaderId() uuid.UUID {
+	return downloader.downloaderId
+}
+
+func (downloader *downloader) GetPriority() pkg.DownloadPriority {
+	return downloader.downloadPrt.GetPriority()
+}
 
-	downloader.intervalByteMutex.Lock()
-	bytes := downloader.intervalBytesDownload
-	downloader.intervalBytesDownload = 0
-	downloader.intervalByteMutex.Unlock()
+// GetInfo returns a snapshot of the download and its stats
+func (downloader *downloader) GetInfo() pkg.DownloadInfo {
+	// the size of a stream is set once it ended
+	downloader.segmentMutex.Lock()
+	fileSize := downloader.resourceInfo.FileSize
+	downloader.segmentMutex.Unlock()
 
-	prevDownloadSpeed := downloader.instantDownloadSpeed
+	return pkg.DownloadInfo{
+		DownloaderId: downloader.downloaderId.String(),
+		Url:          downloader.resourceInfo.Url.String(),
+		FileName:     downloader.resourceInfo.FileName,
+		FileSize:     fileSize,
+		FullPath:     downloader.getFullPath(),
+		Status:       downloader.GetStatus(),
+		Priority:     downloader.GetPriority(),
+		Checksum:     downloader.GetChecksum(),
+		Mirrors:      downloader.mirrors.getUrls(),
+		Threads:      downloader.tuner.getThreads(),
+		Bandwidth:    downloader.GetBandwidthLimit(),
+		Error:        downloader.getErrorMessage(),
+		ErrorDetails: utils.ErrorDetails(downloader.getError()),
+		Stats:        downloader.Stats(),
+	}
+}
 
+// Stats returns the latest snapshot of the stats, it is safe to call at any time
+func (downloader *downloader) Stats() pkg.DownloadStats {
+	return *downloader.stats.Load()
+}
+
+// takeStats stores a new snapshot of the counters of the threads and returns it
+func (downloader *downloader) takeStats() pkg.DownloadStats {
 	elapsedTime := time.Since(downloader.startTime)
-	bytesRead := downloader.bytesDownloaded
-	bytesWritten := downloader.bytesWrittenToDisk
-	writeTime := downloader.writeTime
+	bytesRead := downloader.bytesDownloaded.Load()
+	bytesWritten := downloader.bytesWrittenToDisk.Load()
+	writeTime := time.Duration(downloader.writeTime.Load())
+
+	downloader.segmentMutex.Lock()
 	fileSize := downloader.resourceInfo.FileSize
+	completedSegments := downloader.completedSegments
+	downloader.segmentMutex.Unlock()
 
 	downloadSpeed := float64(bytesRead) / elapsedTime.Seconds()
-	diskWriteSpeed := float64(bytesWritten) / float64(writeTime)
+	var diskWriteSpeed float64
+	if writeTime > 0 {
+		diskWriteSpeed = float64(bytesWritten) / writeTime.Seconds()
+	}
 
-	estimatedRemainigTime := time.Duration(float64(fileSize-bytesRead)/(downloadSpeed)) * time.Second
+	var estimatedRemainigTime time.Duration
+	var progress, consistenProgress float32
+	// without a size only the downloaded bytes are reported
+	if fileSize != pkg.UnknownFileSize {
+		if downloadSpeed > 0 {
+			estimatedRemainigTime = time.Duration(float64(fileSize-bytesRead)/(downloadSpeed)) * time.Second
+		}
 
-	progress := float32(float64(bytesRead) * (100 / float64(fileSize)))
+		progress = float32(float64(bytesRead) * (100 / float64(fileSize)))
 
-	consistenProgress := float32(float64(downloader.completedSegments*configs.SEGMENT_SIZE) * (100 / float64(fileSize)))
+		consistenProgress = float32(float64(min(completedSegments*downloader.segmentSize, fileSize)) * (100 / float64(fileSize)))
+	}
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
-	downloader.downloadStats.UpdateDownloadStats(downloadSpeed, diskWriteSpeed, m.Alloc, elapsedTime, estimatedRemainigTime, progress, consistenProgress)
+	stats := pkg.NewDownloadStats(downloadSpeed, diskWriteSpeed, m.Alloc, elapsedTime, estimatedRemainigTime, progress, consistenProgress, bytesRead)
+	downloader.stats.Store(&stats)
+	return stats
+}
 
-	downloader.instantDownloadSpeed = float64(bytes) / downloader.statsUpdateInterval.Seconds()
+// MonitorDownloadResource takes a new stats snapshot and adjusts the threads
+// to the bytes downloaded since the last one, it runs every stats update
+// interval while the download runs
+func (downloader *downloader) MonitorDownloadResource() {
+	stats := downloader.takeStats()
+	bytes := int(stats.GetBytesDownloaded() - downloader.monitoredBytes)
+	downloader.monitoredBytes = stats.GetBytesDownloaded()
 
-	if downloader.instantDownloadSpeed >= prevDownloadSpeed {
-		downloader.instantDownloadSpeed = downloader.instantDownloadSpeed * 1.1 //10% increase
-	} else {
-		downloader.instantDownloadSpeed = downloader.instantDownloadSpeed * 0.9 //10% decrease
-	}
+	downloader.checkStalls()
 
-	if downloader.instantDownloadSpeed > float64(downloader.maxBandwidth) {
-		downloader.instantDownloadSpeed = float64(downloader.maxBandwidth)
+	if downloader.progress != nil {
+		downloader.progress(stats)
 	}
 
-	if downloader.speedLimited && downloader.instantDownloadSpeed > downloader.maxDownloadSpeed {
-		downloader.instantDownloadSpeed = downloader.maxDownloadSpeed
+	if downloader.tuner.sample(bytes, downloader.statsUpdateInterval) {
+		downloader.SetMaxConnections(downloader.GetMaxConnections())
 	}
 
+	downloader.instantDownloadSpeed = float64(bytes) / downloader.statsUpdateInterval.Seconds()
+	maxBandwidth := downloader.rateLimiter.getRate()
+
 	if time.Since(downloader.lastSyncTime) >= 5*time.Second {
 		downloader.lastSyncTime = time.Now()
+		downloader.segmentMutex.Lock()
+		completedSegments := downloader.completedSegments
+		activeSegments := len(downloader.activeSegments)
+		downloader.segmentMutex.Unlock()
 		fmt.Printf("Time %s %.2f%% | Download Speed: %.2f B/s | Remaining Time: %s | Disk Write Speed: %.2f B/s | \nMemory Alloc: %d bytes | Instatneous Speed %.2f B/s | Consistent Progress %.2f%% | \nCompleted Segments: %d | Active Segments %d | Bandwidth %.2f |\n",
-			elapsedTime.String(), progress, downloadSpeed, estimatedRemainigTime.Truncate(time.Second), diskWriteSpeed, m.Alloc, downloader.instantDownloadSpeed, consistenProgress, downloader.completedSegments, len(downloader.activeSegments), downloader.maxBandwidth)
+			stats.GetElapsedTime().String(), stats.GetProgress(), stats.GetDownloadSpeed(), stats.GetEstimateRemainingTime().Truncate(time.Second), stats.GetDiskWriteSpeed(), stats.GetMemoryUsed(), downloader.instantDownloadSpeed, stats.GetConsistentProgress(), completedSegments, activeSegments, maxBandwidth)
 	}
 }
 
 func (downloader *downloader) StartDownload() {
-	// defer downloader.closeActiveSegments()
 	defer close(downloader.errorChan)
-	defer close(downloader.writeTimeChannel)
-	defer close(downloader.bytesUpdateChannel)
+	defer downloader.client.CloseIdleConnections()
+	defer downloader.dropStream()
 
 	downloader.startTime = time.Now()
+	downloader.statusMutex.Lock()
+	downloader.cause = nil
+	if downloader.status == pkg.Queued {
+		downloader.status = pkg.Probing
+	}
+	downloader.statusMutex.Unlock()
 
-	segmentParentFolder := path.Join(configs.TEMP_DIRECTORY, downloader.downloaderId.String())
-
-	segmentToDownload := make(chan int64)
+	segmentParentFolder := path.Join(configs.Get().TempDirectory, downloader.downloaderId.String())
 
-	go func() {
-		for i := range downloader.totalSegments {
-			segmentToDownload <- i
-		}
-		close(segmentToDownload)
-	}()
+	downloader.findChecksum()
+	downloader.statusMutex.Lock()
+	if downloader.status == pkg.Probing {
+		downloader.status = pkg.Downloading
+	}
+	downloader.statusMutex.Unlock()
 
+	// a repair replaces the channel once this run closed it
+	errorChan := downloader.errorChan
 	go func() {
-		for err := range downloader.errorChan {
+		for err := range errorChan {
 			if err != nil {
 				fmt.Println(err)
-				return
 			}
 		}
 	}()
@@ -229,26 +626,15 @@ func (downloader *downloader) StartDownload() {
 	// monitoring downloader usage
 	ticker := time.NewTicker(downloader.statsUpdateInterval)
 	quit := make(chan struct{})
+	monitorDone := make(chan struct{})
 	go func() {
+		defer close(monitorDone)
 		for {
 			select {
 
 			case <-ticker.C:
 				downloader.MonitorDownloadResource()
 
-			case update := <-downloader.bytesUpdateChannel:
-				if update[0] == 0 {
-					downloader.bytesDownloaded += int64(update[1])
-					downloader.intervalByteMutex.Lock()
-					downloader.intervalBytesDownload += update[1]
-					downloader.intervalByteMutex.Unlock()
-				} else {
-					downloader.bytesWrittenToDisk += int64(update[1])
-				}
-
-			case time := <-downloader.writeTimeChannel:
-				downloader.writeTime += time
-
 			case <-quit:
 				ticker.Stop()
 				return
@@ -258,49 +644,264 @@ func (downloader *downloader) StartDownload() {
 		}
 	}()
 
-	limiter := make(chan uint8, downloader.maxNumberOfSegments)
-	for segmentId := range segmentToDownload {
-		limiter <- 1
-		downloader.waitGroup.Add(1)
+	// downloaded ranges are journaled periodically so a crash loses little progress
+	go func() {
+		journalTicker := time.NewTicker(downloader.journalSyncInterval)
+		defer journalTicker.Stop()
+		for {
+			select {
+			case <-journalTicker.C:
+				downloader.flushJournal()
+				if err := downloader.updateChecksum(); err != nil {
+					fmt.Println("Unable to update checksum", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
 
-		// downloader.activeSegments = append(downloader.activeSegments, segment)
+	for {
+		// wait while the download is paused
+		for downloader.GetStatus() == pkg.Paused {
+			<-downloader.controlChan
+		}
+		if downloader.GetStatus() == pkg.Cancelled {
+			break
+		}
 
-		go func() {
-			defer downloader.waitGroup.Done()
-			segment := CreateNewSegment(segmentId, segmentParentFolder, downloader)
-			downloader.addSegement(segment)
-			segment.StartSegment()
-			downloader.removeSegement(segmentId)
-			fmt.Println("Exiting the segment", segment.segmentId)
-			<-limiter
-		}()
-	}
+		downloader.downloadSegments(segmentParentFolder)
+		downloader.flushJournal()
 
-	downloader.waitGroup.Wait()
+		status := downloader.GetStatus()
+		if status != pkg.Cancelled && downloader.isSwitchingStream() {
+			if err := downloader.resetForSingleStream(); err != nil {
+				downloader.fail(pkg.Failed, err)
+				break
+			}
+			continue
+		}
+		if status == pkg.Paused {
+			fmt.Println("Download paused")
+			continue
+		}
+		if status == pkg.Cancelled || len(downloader.pendingSegments()) == 0 {
+			break
+		}
+		// segments stopped because of errors
+		downloader.fail(pkg.Failed, downloader.failureCause())
+		break
+	}
 	close(quit)
-	close(limiter)
+	<-monitorDone
+	// the last bytes are counted even when the download ended between two updates
+	downloader.takeStats()
+
+	switch downloader.GetStatus() {
+	case pkg.Cancelled:
+		fmt.Println("Download cancelled")
+		downloader.removeCancelledFiles()
+		return
+	case pkg.Failed:
+		fmt.Println(downloader.getErrorMessage())
+		return
+	}
 
 	fmt.Println("Download completed")
 
-	// merge downloaded files
+	// the digest is ready before merging as the segments were hashed while
+	// downloading, a repaired file is hashed after merging
+	repairing := downloader.isRepairing()
+	var checksumErr error
+	if !repairing {
+		checksumErr = downloader.verifyChecksum()
+	}
+
+	// merge downloaded files, nothing is copied when written directly
+	downloader.setStatus(pkg.Merging)
 	if err := downloader.MergeDownload(); err != nil {
 		fmt.Println(err, utils.FileRebiuldError)
+		downloader.fail(pkg.Failed, utils.NewError(utils.FileRebiuldError, err))
 	} else {
-		if err := utils.RenameFile(downloader.fullPath, downloader.resourceInfo.FileName); err != nil {
+		if repairing {
+			checksumErr = downloader.verifyFileChecksum()
+			downloader.endRepair()
+		}
+		if err := downloader.renameFile(); err != nil {
 			fmt.Println(err, utils.DownloadFailedRenameError)
+			downloader.fail(pkg.Failed, utils.NewError(utils.DownloadFailedRenameError, err))
+		} else if errors.Is(checksumErr, utils.ChecksumMismatch) {
+			fmt.Println(checksumErr)
+			downloader.fail(pkg.ChecksumMismatch, checksumErr)
+			downloader.removeTempFiles()
+		} else if checksumErr != nil {
+			fmt.Println("Unable to verify checksum", checksumErr)
+			downloader.fail(pkg.Failed, checksumErr)
+			downloader.removeTempFiles()
+		} else {
+			downloader.setStatus(pkg.Completed)
+			downloader.removeTempFiles()
 		}
 	}
 
 	downloader.runTime = time.Since(downloader.startTime)
 	fmt.Println("Time taken", downloader.runTime)
-	// close(quit)
 
 	return
 }
 
-func (downloader downloader) PrintStruct(place string) {
-	fmt.Println(place, &downloader)
-	v := reflect.ValueOf(downloader)
+// getFullPath returns the temporary file until the download is renamed
+func (downloader *downloader) getFullPath() string {
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+	return downloader.fullPath
+}
+
+// renameFile gives the finished file its name, the file is at its final path
+// afterwards so a repair writes into it
+func (downloader *downloader) renameFile() error {
+	if err := utils.RenameFile(downloader.fullPath, downloader.resourceInfo.FileName); err != nil {
+		return err
+	}
+	downloader.segmentMutex.Lock()
+	downloader.fullPath = filepath.Join(filepath.Dir(downloader.fullPath), downloader.resourceInfo.FileName)
+	downloader.segmentMutex.Unlock()
+	return nil
+}
+
+// downloadSegments runs all pending segments and returns once every segment
+// finished or was stopped
+func (downloader *downloader) downloadSegments(segmentParentFolder string) {
+	stopped := downloader.isStopping
+	for _, segmentId := range downloader.pendingSegments() {
+		if !downloader.segmentLimiter.acquire(stopped) {
+			break
+		}
+		downloader.waitGroup.Add(1)
+
+		go func() {
+			defer downloader.waitGroup.Done()
+			defer downloader.segmentLimiter.release()
+			segment := CreateNewSegment(segmentId, segmentParentFolder, downloader)
+			if segment == nil {
+				downloader.reportError(utils.MissingSegmentFile)
+				return
+			}
+			downloader.addSegement(segment)
+			segment.StartSegment()
+			downloader.removeSegement(segment)
+			fmt.Println("Exiting the segment", segment.segmentId)
+		}()
+	}
+
+	downloader.waitGroup.Wait()
+}
+
+// SetMaxConnections changes the number of connections the download may open,
+// running threads finish their chunk before a lower limit takes effect
+func (downloader *downloader) SetMaxConnections(maxConnections int) {
+	downloader.connectionLimiter.setCapacity(maxConnections)
+	downloader.segmentLimiter.setCapacity(segmentsForConnections(maxConnections, downloader.tuner.getThreads()))
+}
+
+func (downloader *downloader) GetMaxConnections() int {
+	return downloader.connectionLimiter.getCapacity()
+}
+
+// SetMaxBandwidth changes the share of the bandwidth given to the download,
+// 0 is unlimited
+func (downloader *downloader) SetMaxBandwidth(maxBandwidth float64) {
+	downloader.limitMutex.Lock()
+	downloader.maxBandwidth = maxBandwidth
+	downloader.limitMutex.Unlock()
+	downloader.updateRate()
+}
+
+// SetBandwidthLimit limits the download to bytes per second, 0 removes the limit
+func (downloader *downloader) SetBandwidthLimit(bandwidthLimit float64) {
+	downloader.limitMutex.Lock()
+	downloader.bandwidthLimit = max(bandwidthLimit, 0)
+	downloader.limitMutex.Unlock()
+	downloader.updateRate()
+}
+
+func (downloader *downloader) GetBandwidthLimit() float64 {
+	downloader.limitMutex.Lock()
+	defer downloader.limitMutex.Unlock()
+	return downloader.bandwidthLimit
+}
+
+// updateRate limits the download to the lower of its share and its own limit
+func (downloader *downloader) updateRate() {
+	downloader.limitMutex.Lock()
+	rate := downloader.maxBandwidth
+	if downloader.bandwidthLimit > 0 && (rate == 0 || downloader.bandwidthLimit < rate) {
+		rate = downloader.bandwidthLimit
+	}
+	downloader.limitMutex.Unlock()
+	downloader.rateLimiter.setRate(rate)
+}
+
+// getRateLimiters returns the limiters a thread reading from host takes its bytes from
+func (downloader *downloader) getRateLimiters(hostname string) []*rateLimiter {
+	limiters := []*rateLimiter{downloader.rateLimiter}
+	if downloader.bandwidth != nil {
+		limiters = append(limiters, downloader.bandwidth.global, downloader.bandwidth.host(hostname))
+	}
+	return limiters
+}
+
+// segmentsForConnections keeps enough segments running to use every connection
+func segmentsForConnections(maxConnections int, segmentThreads int) int {
+	return (maxConnections + segmentThreads - 1) / segmentThreads
+}
+
+func (downloader *downloader) removeTempFiles() {
+	downloader.journal.close()
+	if err := os.RemoveAll(path.Join(configs.Get().TempDirectory, downloader.downloaderId.String())); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// removeSegmentFiles removes the files kept next to the journal of a download
+func removeSegmentFiles(downloaderId uuid.UUID) error {
+	tempFolder := path.Join(configs.Get().TempDirectory, downloaderId.String())
+	entries, err := os.ReadDir(tempFolder)
+	if err != nil {
+		return utils.NewError(utils.FileReadPermissionError, err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == configs.JOURNAL_FILE {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(tempFolder, entry.Name())); err != nil {
+			return utils.NewError(utils.FileWritePermissionError, err)
+		}
+	}
+	return nil
+}
+
+func (downloader *downloader) removeDownloadFiles() {
+	downloader.removeTempFiles()
+	if err := os.Remove(downloader.fullPath); err != nil && !os.IsNotExist(err) {
+		fmt.Println(err)
+	}
+}
+
+// removeCancelledFiles removes the files of a cancelled download, a cancelled
+// repair keeps the finished file it was repairing
+func (downloader *downloader) removeCancelledFiles() {
+	if downloader.isRepairing() {
+		downloader.endRepair()
+		downloader.removeTempFiles()
+		return
+	}
+	downloader.removeDownloadFiles()
+}
+
+func (downloader *downloader) PrintStruct(place string) {
+	fmt.Println(place, downloader)
+	v := reflect.ValueOf(downloader).Elem()
 	typeOfS := v.Type()
 
 	for i := 0; i < v.NumField(); i++ {
@@ -309,88 +910,348 @@ func (downloader downloader) PrintStruct(place string) {
 	fmt.Printf("\n")
 }
 
-func (downloader downloader) MergeDownload() error {
+func (downloader *downloader) MergeDownload() error {
+	if downloader.directWrite {
+		// the segments were written into the file, a restarted stream may
+		// have left bytes past its end
+		if downloader.resourceInfo.FileSize != pkg.UnknownFileSize {
+			if err := os.Truncate(downloader.fullPath, downloader.resourceInfo.FileSize); err != nil {
+				return utils.NewError(utils.FileWritePermissionError, err)
+			}
+		}
+		return nil
+	}
 	fmt.Println("Merging downloads")
-	tempFolder := path.Join(configs.TEMP_DIRECTORY, downloader.downloaderId.String())
+	tempFolder := path.Join(configs.Get().TempDirectory, downloader.downloaderId.String())
+	var segments []int64
 	for i := range downloader.totalSegments {
+		if downloader.repairSegments != nil && !downloader.repairSegments[i] {
+			// the file already holds the segment
+			continue
+		}
 		filePath := path.Join(tempFolder, strconv.FormatInt(i, 10)+configs.SEG_EXT)
-
-		if err := utils.MergeSegment(i*configs.SEGMENT_SIZE, filePath, downloader.fullPath); err != nil {
-			fmt.Println(err)
-			return err
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			// merged before a restart, segment files are removed once merged
+			continue
 		}
+		segments = append(segments, i)
 	}
-	return nil
+
+	workers, err := downloader.mergeWorkers(len(segments))
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var mergeErr error
+	var errMutex sync.Mutex
+	limiter := make(chan uint8, workers)
+	for _, segmentId := range segments {
+		limiter <- 1
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			filePath := path.Join(tempFolder, strconv.FormatInt(segmentId, 10)+configs.SEG_EXT)
+			if err := utils.MergeSegment(segmentId*downloader.segmentSize, filePath, downloader.fullPath); err != nil {
+				fmt.Println(err)
+				errMutex.Lock()
+				mergeErr = err
+				errMutex.Unlock()
+			}
+			<-limiter
+		}()
+	}
+	wg.Wait()
+	return mergeErr
 }
 
-func (downloader *downloader) closeActiveSegments() {
-	for _, segment := range downloader.activeSegments {
-		segment.controlChan <- 1
+// mergeWorkers returns how many segments are merged at the same time, a
+// segment copied into the file takes its size on disk until it is removed
+func (downloader *downloader) mergeWorkers(segments int) (int, error) {
+	workers := min(maxMergeWorkers, segments)
+	free, err := utils.FreeSpace(path.Dir(downloader.fullPath))
+	if err != nil || free < 0 || workers == 0 {
+		return max(workers, 1), nil
+	}
+	segmentSize := min(downloader.segmentSize, max(downloader.resourceInfo.FileSize, 1))
+	if free < segmentSize {
+		return 0, utils.NoEnoughSpace
 	}
+	return int(min(int64(workers), free/segmentSize)), nil
 }
 
-func CreateDownloader(resourceUrl string, downloadPrt pkg.DownloadSpeed) (*downloader, error) {
+// closeActiveSegments signals every running segment, segmentMutex must be held
+func (downloader *downloader) closeActiveSegments(signal uint8) {
+	for _, segment := range downloader.activeSegments {
+		segment.stop(signal)
+	}
+}
 
-	downloader := downloader{}
+// CreateDownloader probes the resource and prepares its download, ctx ends
+// the requests made until the download is created. The headers of the
+// download are only sent to the host of resourceUrl.
+func CreateDownloader(ctx context.Context, resourceUrl string, downloadPrt pkg.DownloadSpeed) (*downloader, error) {
 
-	resourceInfo, err := utils.GetMetaData(resourceUrl)
+	resourceInfo, err := utils.GetMetaData(ctx, resourceUrl, downloadPrt.GetHeaders())
 	if err != nil {
 		return nil, err
 	}
 
-	totalSegments := resourceInfo.FileSize / configs.SEGMENT_SIZE
+	if utils.IsMetalink(resourceInfo.FinalUrl.Path, resourceInfo.ContentType) {
+		resourceInfo.Client.CloseIdleConnections()
+		headers := utils.ScopeHeaders(downloadPrt.GetHeaders(), resourceInfo.Url, resourceInfo.FinalUrl)
+		metalink, err := utils.FetchMetalink(ctx, resourceInfo.FinalUrl, headers)
+		if err != nil {
+			return nil, err
+		}
+		return createMetalinkDownloader(ctx, metalink, downloadPrt, resourceInfo.Url)
+	}
+
+	return createDownloader(ctx, resourceInfo, downloadPrt)
+}
 
-	if totalSegments*configs.SEGMENT_SIZE != resourceInfo.FileSize {
-		totalSegments++
+// CreateMetalinkDownloader downloads the file described by a metalink, the
+// most preferred url serving the file is used and the urls after it become
+// its mirrors. The headers of the download are only sent to the host of the
+// first url of the metalink.
+func CreateMetalinkDownloader(ctx context.Context, metalink *utils.Metalink, downloadPrt pkg.DownloadSpeed) (*downloader, error) {
+	var origin *url.URL
+	if len(metalink.Urls) > 0 {
+		origin, _ = url.Parse(metalink.Urls[0].Url)
 	}
+	return createMetalinkDownloader(ctx, metalink, downloadPrt, origin)
+}
 
-	fmt.Println("File size", resourceInfo.FileSize, "Total segments", totalSegments)
+// createMetalinkDownloader sends the headers only to the host of origin
+func createMetalinkDownloader(ctx context.Context, metalink *utils.Metalink, downloadPrt pkg.DownloadSpeed, origin *url.URL) (*downloader, error) {
+	downloadType := copyDownloadType(downloadPrt)
+	downloadType.Mirrors = nil
+	downloadType.Pieces = metalink.Pieces
+	if downloadType.Checksum == nil {
+		downloadType.Checksum = metalink.Checksum
+	}
+
+	for i, metalinkUrl := range metalink.Urls {
+		parsedUrl, err := url.Parse(metalinkUrl.Url)
+		if err != nil {
+			fmt.Println("Skipping metalink url", metalinkUrl.Url, err)
+			continue
+		}
+		resourceInfo, err := utils.GetMetaData(ctx, metalinkUrl.Url, utils.ScopeHeaders(downloadPrt.GetHeaders(), origin, parsedUrl))
+		if err != nil {
+			fmt.Println("Skipping metalink url", metalinkUrl.Url, err)
+			continue
+		}
+		if metalink.FileSize != pkg.UnknownFileSize && resourceInfo.FileSize != metalink.FileSize {
+			fmt.Println("Skipping metalink url", metalinkUrl.Url, "size differs")
+			resourceInfo.Client.CloseIdleConnections()
+			continue
+		}
+
+		for _, mirror := range metalink.Urls[i+1:] {
+			downloadType.Mirrors = append(downloadType.Mirrors, mirror.Url)
+		}
+		downloadType.Mirrors = append(downloadType.Mirrors, downloadPrt.GetMirrors()...)
+		resourceInfo.FileName = metalink.FileName
+
+		// the download sends its headers to the host of its url only
+		downloadType.Headers = utils.ScopeHeaders(downloadType.Headers, origin, parsedUrl)
+
+		fmt.Println("Downloading", metalink.FileName, "from", metalinkUrl.Url, "location", metalinkUrl.Location)
+		return createDownloader(ctx, resourceInfo, downloadType)
+	}
+	return nil, utils.MetalinkUnavailable
+}
+
+func createDownloader(ctx context.Context, resourceInfo *pkg.ResourceInfo, downloadPrt pkg.DownloadSpeed) (*downloader, error) {
+	// published piece hashes let every segment be verified on its own
+	if downloadPrt.GetPieces() == nil && resourceInfo.Resumeable {
+		if pieces := utils.FindPieces(ctx, resourceInfo.Url, resourceInfo.FileSize, downloadPrt.GetHeaders()); pieces != nil {
+			fmt.Println("Verifying segments with", len(pieces.Hashes), "piece hashes")
+			downloadType := copyDownloadType(downloadPrt)
+			downloadType.Pieces = pieces
+			downloadPrt = downloadType
+		}
+	}
+	resourceInfo.Mirrors = resolveMirrors(ctx, resourceInfo, downloadPrt)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	parentDir := utils.GetDownloadFolder(path.Ext((*resourceInfo.Url).Path))
+	if fileName := utils.SanitizeFileName(downloadPrt.GetFileName()); fileName != "" {
+		resourceInfo.FileName = fileName
+	}
+	parentDir := downloadPrt.GetDirectory()
+	if parentDir == "" {
+		parentDir = utils.GetDownloadFolder(path.Ext(resourceInfo.FileName))
+	}
 
+	// the file is written under a temporary name, which may be numbered when
+	// the file name is taken
 	fullPath, err := utils.CreateFile(parentDir, (*resourceInfo).FileName, (*resourceInfo).FileSize)
 
 	if err != nil {
 		return nil, err
 	}
+	resourceInfo.FileName = filepath.Base(utils.FinalPath(fullPath))
+
+	return newDownloader(uuid.New(), resourceInfo, downloadPrt, fullPath, configs.Get().SegmentSize, nil, nil, configs.Get().DirectWrite)
+}
+
+func copyDownloadType(downloadPrt pkg.DownloadSpeed) *pkg.DownloadType {
+	return &pkg.DownloadType{
+		MaxThreadCount: downloadPrt.GetMaxThreads(),
+		Priority:       downloadPrt.GetPriority(),
+		Checksum:       downloadPrt.GetChecksum(),
+		Mirrors:        downloadPrt.GetMirrors(),
+		Pieces:         downloadPrt.GetPieces(),
+		Bandwidth:      downloadPrt.GetBandwidth(),
+		Headers:        downloadPrt.GetHeaders(),
+		FileName:       downloadPrt.GetFileName(),
+		Directory:      downloadPrt.GetDirectory(),
+	}
+}
+
+// RestoreDownloaders recreates every download which has a journal in the
+// temporary directory, only the missing byte ranges are downloaded again
+func RestoreDownloaders() ([]*downloader, error) {
+	entries, err := os.ReadDir(configs.Get().TempDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, utils.NewError(utils.FileReadPermissionError, err)
+	}
+
+	var downloaders []*downloader
+	for _, entry := range entries {
+		downloaderId, err := uuid.Parse(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		downloader, err := RestoreDownloader(downloaderId)
+		if err != nil {
+			fmt.Println("Unable to restore download", downloaderId, err)
+			continue
+		}
+		downloaders = append(downloaders, downloader)
+	}
+	return downloaders, nil
+}
+
+func RestoreDownloader(downloaderId uuid.UUID) (*downloader, error) {
+	header, chunks, err := readJournal(getJournalPath(downloaderId))
+	if err != nil {
+		return nil, err
+	}
+
+	// the server refuses every request made without the credentials, which
+	// were never written to disk, so the download is dropped
+	if header.CredentialsDropped {
+		if err := os.RemoveAll(path.Join(configs.Get().TempDirectory, downloaderId.String())); err != nil {
+			fmt.Println(err)
+		}
+		if err := os.Remove(header.FullPath); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+		}
+		return nil, utils.NewError(utils.CredentialsMissing, nil).InDownload(downloaderId)
+	}
+
+	resourceInfo, err := utils.GetMetaData(context.Background(), header.Url, header.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	// progress is only valid for the same resource, the segment size of the
+	// journal is kept as the segment files were written with it
+	changed := resourceInfo.FileSize != header.FileSize || (header.ETag != "" && resourceInfo.ETag != header.ETag) || header.SegmentSize <= 0
+	if changed {
+		fmt.Println("Resource changed since last run, downloading again", header.Url)
+		chunks = nil
+	}
+	resourceInfo.FileName = header.FileName
+
+	fullPath := header.FullPath
+	if changed {
+		// bytes of the old resource left in the files would end up in the new one
+		if err := removeSegmentFiles(downloaderId); err != nil {
+			return nil, err
+		}
+		err = utils.ResetFile(fullPath, resourceInfo.FileSize)
+	} else {
+		err = utils.OpenFile(fullPath, resourceInfo.FileSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	downloadType := &pkg.DownloadType{MaxThreadCount: header.MaxThreadCount, Priority: header.Priority, Checksum: header.Checksum, Mirrors: header.Mirrors, Pieces: header.Pieces, Bandwidth: header.Bandwidth, Headers: header.Headers}
+	resourceInfo.Mirrors = resolveMirrors(context.Background(), resourceInfo, downloadType)
+	// the journaled ranges are in the segment files or in the file itself
+	// depending on the mode the download was started with
+	segmentSize := header.SegmentSize
+	directWrite := header.DirectWrite
+	if chunks == nil {
+		segmentSize = configs.Get().SegmentSize
+		directWrite = configs.Get().DirectWrite
+	}
+	return newDownloader(downloaderId, resourceInfo, downloadType, fullPath, segmentSize, chunks, header.RepairSegments, directWrite)
+}
+
+// newDownloader creates the downloader along with its journal, chunks are the
+// byte ranges already present in the segment files, or in the file when
+// directWrite is set, and repairSegments the segments of a verified file
+// being downloaded again
+func newDownloader(downloaderId uuid.UUID, resourceInfo *pkg.ResourceInfo, downloadPrt pkg.DownloadSpeed, fullPath string, segmentSize int64, chunks [][2]int64, repairSegments []int64, directWrite bool) (*downloader, error) {
+
+	downloader := downloader{}
+
+	// without range support the whole file is a single segment
+	streaming := resourceInfo.FileSize == pkg.UnknownFileSize
+	if !resourceInfo.Resumeable {
+		segmentSize = max(resourceInfo.FileSize, 1)
+		chunks = nil
+	}
+	if streaming {
+		segmentSize = math.MaxInt64
+	}
+
+	pieces := downloadPrt.GetPieces()
+	if pieces != nil && (streaming || pieces.Count(resourceInfo.FileSize) != int64(len(pieces.Hashes)) || utils.NewHash(pieces.Algorithm) == nil) {
+		fmt.Println("Ignoring piece hashes not matching the file")
+		pieces = nil
+	}
+	// segments hold whole pieces so each segment is verified on its own
+	if pieces != nil && segmentSize%pieces.Length != 0 {
+		segmentSize = (segmentSize/pieces.Length + 1) * pieces.Length
+	}
+	totalSegments := getTotalSegments(resourceInfo.FileSize, segmentSize)
+
+	fmt.Println("File size", resourceInfo.FileSize, "Total segments", totalSegments)
 
 	var wg sync.WaitGroup
 
 	// channels
 	errorChan := make(chan error)
-	writeTimeChannel := make(chan time.Duration)
-	bytesUpdateCahnnel := make(chan [2]int)
 
 	statsUpdateInterval := 1 * time.Second
-	maxBandwidth := 1.0 * configs.BANDWIDTH
-
-	var writeTime time.Duration = 0
+	maxBandwidth := 1.0 * configs.Get().Bandwidth
 
-	var intervalByteMutex sync.Mutex
 	var segmentMutex sync.Mutex
 
-	stat := pkg.NewDownloadStats()
-
 	activeSegments := make(map[int64]*Segment)
 
-	speedLimited := false
-	maxDownloadSpeed := math.MaxFloat64
+	bandwidthLimit := downloadPrt.GetBandwidth()
 
-	maxNumberSegments := 20
+	maxConnections := configs.Get().MaxConnections
 
 	downloader.Intalize(
-		uuid.New(),
+		downloaderId,
 		resourceInfo,
-		stat,
 		downloadPrt,
 		fullPath,
 
-		writeTime,
-		writeTimeChannel,
-
-		bytesUpdateCahnnel,
-
-		maxNumberSegments,
+		maxConnections,
 		totalSegments,
 
 		activeSegments,
@@ -402,10 +1263,118 @@ func CreateDownloader(resourceUrl string, downloadPrt pkg.DownloadSpeed) (*downl
 		statsUpdateInterval,
 		maxBandwidth,
 
-		&intervalByteMutex,
-
-		speedLimited,
-		maxDownloadSpeed,
+		bandwidthLimit,
 	)
+
+	downloader.segmentSize = segmentSize
+	// MaxThreadCount is the ceiling of the threads a segment runs
+	downloader.tuner = newThreadTuner(downloadPrt.GetMaxThreads())
+	downloader.retryPolicy = newRetryPolicy(configs.Get())
+	downloader.SetMaxConnections(maxConnections)
+	if resourceInfo.Client != nil {
+		downloader.client = resourceInfo.Client
+	}
+	downloader.mirrors = newMirrorSet(append([]*url.URL{downloader.GetDownloadUrl()}, resourceInfo.Mirrors...))
+	downloader.singleStream = !resourceInfo.Resumeable
+	downloader.streaming = streaming
+	downloader.pieces = pieces
+	downloader.directWrite = directWrite
+	// a repair is only continued when the journaled progress is still valid
+	if chunks != nil && len(repairSegments) > 0 {
+		downloader.repairSegments = make(map[int64]bool)
+		for _, segmentId := range repairSegments {
+			downloader.repairSegments[segmentId] = true
+		}
+	}
+
+	journal, err := createJournal(downloader.getJournalHeader(), chunks)
+	if err != nil {
+		return nil, err
+	}
+	downloader.journal = journal
+	downloader.restoreProgress(chunks)
+
 	return &downloader, nil
 }
+
+func getTotalSegments(fileSize int64, segmentSize int64) int64 {
+	if fileSize == pkg.UnknownFileSize {
+		return 1
+	}
+	totalSegments := fileSize / segmentSize
+
+	if totalSegments*segmentSize != fileSize {
+		totalSegments++
+	}
+	return totalSegments
+}
+
+func (downloader *downloader) getJournalHeader() journalHeader {
+	headers := utils.WithoutCredentials(downloader.downloadPrt.GetHeaders())
+	return journalHeader{
+		DownloaderId:   downloader.downloaderId,
+		Url:            downloader.resourceInfo.Url.String(),
+		FileName:       downloader.resourceInfo.FileName,
+		FileSize:       downloader.resourceInfo.FileSize,
+		FullPath:       downloader.fullPath,
+		SegmentSize:    downloader.segmentSize,
+		MaxThreadCount: downloader.downloadPrt.GetMaxThreads(),
+		Priority:       downloader.downloadPrt.GetPriority(),
+		Checksum:       downloader.downloadPrt.GetChecksum(),
+		Mirrors:        downloader.downloadPrt.GetMirrors(),
+		Pieces:         downloader.downloadPrt.GetPieces(),
+		Bandwidth:      downloader.GetBandwidthLimit(),
+		Headers:        headers,
+		RepairSegments: downloader.getRepairSegments(),
+		DirectWrite:    downloader.directWrite,
+		ETag:           downloader.resourceInfo.ETag,
+
+		CredentialsDropped: len(headers) != len(downloader.downloadPrt.GetHeaders()),
+	}
+}
+
+// getRepairSegments returns the segments being repaired, segmentMutex must be held
+func (downloader *downloader) getRepairSegments() []int64 {
+	var segments []int64
+	for segmentId := range downloader.repairSegments {
+		segments = append(segments, segmentId)
+	}
+	slices.Sort(segments)
+	return segments
+}
+
+// restoreProgress splits the journaled ranges by segment
+func (downloader *downloader) restoreProgress(chunks [][2]int64) {
+	for _, chunk := range chunks {
+		for chunk[0] < chunk[1] {
+			segmentId := chunk[0] / downloader.segmentSize
+			segmentEnd := min((segmentId+1)*downloader.segmentSize, downloader.resourceInfo.FileSize)
+			end := min(chunk[1], segmentEnd)
+			downloader.segmentProgress[segmentId] = mergeChunk(downloader.segmentProgress[segmentId], [2]int64{chunk[0], end})
+			// segments verified by pieces are checked again before they are
+			// finished, except the good segments of a repaired file
+			if (downloader.pieces == nil || (downloader.repairSegments != nil && !downloader.repairSegments[segmentId])) && len(downloader.segmentProgress[segmentId]) == 1 &&
+				downloader.segmentProgress[segmentId][0] == [2]int64{segmentId * downloader.segmentSize, segmentEnd} {
+				downloader.finishedSegments[segmentId] = true
+				downloader.completedSegments++
+				delete(downloader.segmentProgress, segmentId)
+			}
+			chunk[0] = end
+		}
+	}
+}
+
+// flushJournal writes the downloaded ranges to the journal after syncing the
+// segment files they were written to
+func (downloader *downloader) flushJournal() {
+	err := downloader.journal.flush(func() {
+		downloader.segmentMutex.Lock()
+		defer downloader.segmentMutex.Unlock()
+		for _, segment := range downloader.activeSegments {
+			segment.syncFile()
+		}
+	})
+	if err != nil {
+		fmt.Println("Unable to update download journal", err)
+	}
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+	"github.com/google/uuid"
+)
+
+func TestFail(t *testing.T) {
+	downloader := &downloader{downloaderId: uuid.New(), statusMutex: &sync.Mutex{}}
+
+	downloader.fail(pkg.Failed, utils.ChecksumMismatch)
+	if !errors.Is(downloader.getError(), utils.ChecksumMismatch) {
+		t.Fatalf("error %v, want ChecksumMismatch", downloader.getError())
+	}
+	if details := utils.ErrorDetails(downloader.getError()); details == nil || details.Kind != utils.ChecksumMismatch.Error() {
+		t.Fatalf("details %+v", details)
+	}
+
+	// a verify finding the file intact clears the reason
+	downloader.fail(pkg.Completed, nil)
+	if downloader.GetStatus() != pkg.Completed || downloader.getError() != nil || downloader.getErrorMessage() != "" {
+		t.Fatalf("status %s error %v", downloader.GetStatus(), downloader.getError())
+	}
+	if details := utils.ErrorDetails(downloader.getError()); details != nil {
+		t.Fatalf("details %+v, want nil", details)
+	}
+}
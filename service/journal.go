@@ -0,0 +1,225 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/arun-kushwaha04/DownloadHub/configs"
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+	"github.com/google/uuid"
+)
+
+// journalHeader is the first line of a journal, it holds everything needed to
+// recreate the downloader after a restart
+type journalHeader struct {
+	DownloaderId   uuid.UUID `json:"downloaderId"`
+	Url            string    `json:"url"`
+	FileName       string    `json:"fileName"`
+	FileSize       int64     `json:"fileSize"`
+	FullPath       string    `json:"fullPath"`
+	SegmentSize    int64     `json:"segmentSize"`
+	MaxThreadCount uint8     `json:"maxThreadCount"`
+
+	Priority pkg.DownloadPriority `json:"priority"`
+	Checksum *pkg.Checksum        `json:"checksum,omitempty"`
+	Mirrors  []string             `json:"mirrors,omitempty"`
+	Pieces   *pkg.Pieces          `json:"pieces,omitempty"`
+
+	Bandwidth float64           `json:"bandwidth,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+
+	RepairSegments []int64 `json:"repairSegments,omitempty"`
+	DirectWrite    bool    `json:"directWrite,omitempty"`
+	ETag           string  `json:"etag,omitempty"`
+
+	CredentialsDropped bool `json:"credentialsDropped,omitempty"` // credential headers were left out of the journal
+}
+
+// journal is an append only log of downloaded byte ranges, every line after
+// the header is a "start end" pair of absolute file offsets. Ranges are
+// buffered and written by flush after the segment files are synced so a
+// range is never journaled before its bytes are on disk.
+type journal struct {
+	file      *os.File
+	fileMutex *sync.Mutex
+
+	pending [][2]int64
+	mutex   *sync.Mutex
+}
+
+func getJournalPath(downloaderId uuid.UUID) string {
+	return path.Join(configs.Get().TempDirectory, downloaderId.String(), configs.JOURNAL_FILE)
+}
+
+// createJournal writes a new journal containing the header and the already
+// downloaded ranges
+func createJournal(header journalHeader, chunks [][2]int64) (*journal, error) {
+	file, err := writeJournal(header, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{
+		file:      file,
+		fileMutex: &sync.Mutex{},
+		mutex:     &sync.Mutex{},
+	}, nil
+}
+
+// writeJournal writes the journal and returns it opened for appending
+func writeJournal(header journalHeader, chunks [][2]int64) (*os.File, error) {
+	journalPath := getJournalPath(header.DownloaderId)
+	if err := os.MkdirAll(path.Dir(journalPath), os.ModePerm); err != nil {
+		return nil, utils.NewError(utils.TempDirCreatePermissionError, err)
+	}
+
+	// journal is rewritten in a temporary file so a crash never leaves it half written
+	tempPath := journalPath + configs.TEMP_EXT
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, utils.NewError(utils.FileCreatePermissionError, err)
+	}
+
+	writer := bufio.NewWriter(file)
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	writer.Write(headerBytes)
+	writer.WriteString("\n")
+	for _, chunk := range chunks {
+		fmt.Fprintf(writer, "%d %d\n", chunk[0], chunk[1])
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return nil, utils.NewError(utils.FileWritePermissionError, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, utils.NewError(utils.FileWritePermissionError, err)
+	}
+	file.Close()
+
+	if err := os.Rename(tempPath, journalPath); err != nil {
+		return nil, utils.NewError(utils.FileRenameError, err)
+	}
+
+	file, err = os.OpenFile(journalPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, utils.NewError(utils.FileWritePermissionError, err)
+	}
+	return file, nil
+}
+
+// readJournal returns the header and the downloaded ranges merged together,
+// a torn last line left by a crash is ignored
+func readJournal(journalPath string) (*journalHeader, [][2]int64, error) {
+	file, err := os.Open(journalPath)
+	if err != nil {
+		return nil, nil, utils.NewError(utils.FileNotFound, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// piece hashes make the header longer than the default line limit
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	if !scanner.Scan() {
+		return nil, nil, utils.NewError(utils.InvalidJournal, scanner.Err())
+	}
+
+	var header journalHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, nil, utils.NewError(utils.InvalidJournal, err)
+	}
+
+	var chunks [][2]int64
+	for scanner.Scan() {
+		var chunk [2]int64
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &chunk[0], &chunk[1]); err != nil {
+			break
+		}
+		if chunk[0] < 0 || chunk[1] > header.FileSize || chunk[0] >= chunk[1] {
+			break
+		}
+		chunks = mergeChunk(chunks, chunk)
+	}
+
+	return &header, chunks, nil
+}
+
+func (journal *journal) record(chunk [2]int64) {
+	journal.mutex.Lock()
+	journal.pending = append(journal.pending, chunk)
+	journal.mutex.Unlock()
+}
+
+// flush syncs the files holding the pending ranges and appends them to the journal
+func (journal *journal) flush(syncFiles func()) error {
+	journal.fileMutex.Lock()
+	defer journal.fileMutex.Unlock()
+
+	journal.mutex.Lock()
+	pending := journal.pending
+	journal.pending = nil
+	journal.mutex.Unlock()
+
+	if journal.file == nil || len(pending) == 0 {
+		return nil
+	}
+
+	syncFiles()
+
+	writer := bufio.NewWriter(journal.file)
+	for _, chunk := range pending {
+		fmt.Fprintf(writer, "%d %d\n", chunk[0], chunk[1])
+	}
+	err := writer.Flush()
+	if err == nil {
+		err = journal.file.Sync()
+	}
+	if err != nil {
+		// keep the ranges so they are written by the next flush
+		journal.mutex.Lock()
+		journal.pending = append(pending, journal.pending...)
+		journal.mutex.Unlock()
+		return utils.NewError(utils.FileWritePermissionError, err)
+	}
+	return nil
+}
+
+func (journal *journal) close() {
+	journal.fileMutex.Lock()
+	defer journal.fileMutex.Unlock()
+
+	if journal.file != nil {
+		journal.file.Close()
+		journal.file = nil
+	}
+}
+
+// reset replaces the journal with a new one holding no downloaded ranges
+func (journal *journal) reset(header journalHeader) error {
+	journal.fileMutex.Lock()
+	defer journal.fileMutex.Unlock()
+
+	journal.mutex.Lock()
+	journal.pending = nil
+	journal.mutex.Unlock()
+
+	if journal.file != nil {
+		journal.file.Close()
+		journal.file = nil
+	}
+	file, err := writeJournal(header, nil)
+	if err != nil {
+		return err
+	}
+	journal.file = file
+	return nil
+}
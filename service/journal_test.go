@@ -0,0 +1,240 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/configs"
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+	"github.com/google/uuid"
+)
+
+func TestMergeChunk(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][2]int64
+		chunk  [2]int64
+		want   [][2]int64
+	}{
+		{"empty", nil, [2]int64{0, 10}, [][2]int64{{0, 10}}},
+		{"before", [][2]int64{{20, 30}}, [2]int64{0, 10}, [][2]int64{{0, 10}, {20, 30}}},
+		{"after", [][2]int64{{0, 10}}, [2]int64{20, 30}, [][2]int64{{0, 10}, {20, 30}}},
+		{"touching", [][2]int64{{0, 10}}, [2]int64{10, 20}, [][2]int64{{0, 20}}},
+		{"overlapping", [][2]int64{{0, 10}}, [2]int64{5, 20}, [][2]int64{{0, 20}}},
+		{"inside", [][2]int64{{0, 30}}, [2]int64{10, 20}, [][2]int64{{0, 30}}},
+		{"covering", [][2]int64{{10, 20}}, [2]int64{0, 30}, [][2]int64{{0, 30}}},
+		{"joining", [][2]int64{{0, 10}, {20, 30}, {40, 50}}, [2]int64{5, 25}, [][2]int64{{0, 30}, {40, 50}}},
+		{"filling a gap", [][2]int64{{0, 10}, {20, 30}}, [2]int64{10, 20}, [][2]int64{{0, 30}}},
+		{"between", [][2]int64{{0, 10}, {40, 50}}, [2]int64{20, 30}, [][2]int64{{0, 10}, {20, 30}, {40, 50}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mergeChunk(test.chunks, test.chunk); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRemoveChunk(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks [][2]int64
+		chunk  [2]int64
+		want   [][2]int64
+	}{
+		{"empty", nil, [2]int64{0, 10}, nil},
+		{"disjoint", [][2]int64{{0, 10}}, [2]int64{10, 20}, [][2]int64{{0, 10}}},
+		{"whole", [][2]int64{{0, 10}}, [2]int64{0, 10}, nil},
+		{"start", [][2]int64{{0, 10}}, [2]int64{0, 5}, [][2]int64{{5, 10}}},
+		{"end", [][2]int64{{0, 10}}, [2]int64{5, 10}, [][2]int64{{0, 5}}},
+		{"middle", [][2]int64{{0, 30}}, [2]int64{10, 20}, [][2]int64{{0, 10}, {20, 30}}},
+		{"overlapping two", [][2]int64{{0, 10}, {20, 30}}, [2]int64{5, 25}, [][2]int64{{0, 5}, {25, 30}}},
+		{"covering", [][2]int64{{10, 20}, {30, 40}}, [2]int64{0, 50}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := removeChunk(test.chunks, test.chunk); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadJournal(t *testing.T) {
+	const header = `{"url":"http://localhost/file.bin","fileName":"file.bin","fileSize":100}` + "\n"
+	tests := []struct {
+		name    string
+		content string
+		want    [][2]int64
+		wantErr error
+	}{
+		{"header only", header, nil, nil},
+		{"ranges merged", header + "0 10\n20 30\n10 20\n", [][2]int64{{0, 30}}, nil},
+		{"torn last line", header + "0 10\n20 3", [][2]int64{{0, 10}}, nil},
+		{"garbage line", header + "0 10\nxx\n20 30\n", [][2]int64{{0, 10}}, nil},
+		{"past the end", header + "0 10\n90 110\n", [][2]int64{{0, 10}}, nil},
+		{"negative start", header + "-5 10\n", nil, nil},
+		{"empty range", header + "10 10\n", nil, nil},
+		{"empty file", "", nil, utils.InvalidJournal},
+		{"torn header", header[:20], nil, utils.InvalidJournal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			journalPath := filepath.Join(t.TempDir(), "download.journal")
+			if err := os.WriteFile(journalPath, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, chunks, err := readJournal(journalPath)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got error %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.FileSize != 100 || got.FileName != "file.bin" {
+				t.Fatalf("header %+v", got)
+			}
+			if !reflect.DeepEqual(chunks, test.want) {
+				t.Fatalf("got %v, want %v", chunks, test.want)
+			}
+		})
+	}
+}
+
+func TestReadMissingJournal(t *testing.T) {
+	_, _, err := readJournal(filepath.Join(t.TempDir(), "download.journal"))
+	if !errors.Is(err, utils.FileNotFound) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v, want FileNotFound caused by a missing file", err)
+	}
+}
+
+func TestRestoreChangedResource(t *testing.T) {
+	const segmentSize = 512 * 1024
+	oldData := randomData(t, 3*segmentSize)
+	tests := []struct {
+		name string
+		data []byte // served after the restart
+		etag string
+	}{
+		{"smaller", randomData(t, 2*segmentSize), `"v1"`},
+		{"same size new etag", randomData(t, 3*segmentSize), `"v2"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := setTestConfig(t)
+			var mutex sync.Mutex
+			data, etag := oldData, `"v1"`
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mutex.Lock()
+				content, tag := data, etag
+				mutex.Unlock()
+				w.Header().Set("ETag", tag)
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+			}))
+			t.Cleanup(server.Close)
+
+			// an interrupted run of the old resource, its first segment is journaled
+			downloaderId := uuid.New()
+			fullPath := filepath.Join(config.DownloadDirectory, "file.bin"+configs.TEMP_EXT)
+			if err := os.WriteFile(fullPath, oldData, 0644); err != nil {
+				t.Fatal(err)
+			}
+			journalFile, err := writeJournal(journalHeader{
+				DownloaderId: downloaderId,
+				Url:          server.URL + "/file.bin",
+				FileName:     "file.bin",
+				FileSize:     int64(len(oldData)),
+				FullPath:     fullPath,
+				SegmentSize:  segmentSize,
+				ETag:         `"v1"`,
+			}, [][2]int64{{0, segmentSize}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			journalFile.Close()
+			tempFolder := filepath.Join(config.TempDirectory, downloaderId.String())
+			for segmentId := range 3 {
+				segment := oldData[segmentId*segmentSize : (segmentId+1)*segmentSize]
+				if err := os.WriteFile(filepath.Join(tempFolder, strconv.Itoa(segmentId)+configs.SEG_EXT), segment, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mutex.Lock()
+			data, etag = test.data, test.etag
+			mutex.Unlock()
+
+			downloader, err := RestoreDownloader(downloaderId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(test.data) < len(oldData) {
+				if _, err := os.Stat(filepath.Join(tempFolder, "2"+configs.SEG_EXT)); !os.IsNotExist(err) {
+					t.Fatalf("segment file of the old resource kept: %v", err)
+				}
+			}
+			manager := NewManager()
+			t.Cleanup(manager.Close)
+			manager.add(downloader)
+			<-downloader.done
+
+			if status := downloader.GetStatus(); status != pkg.Completed {
+				t.Fatalf("status %s: %v", status, downloader.getError())
+			}
+			got, err := os.ReadFile(downloader.getFullPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.data) {
+				t.Fatalf("restored file of %d bytes differs from the %d bytes served", len(got), len(test.data))
+			}
+		})
+	}
+}
+
+func TestRestoreWithoutCredentials(t *testing.T) {
+	config := setTestConfig(t)
+	downloaderId := uuid.New()
+	fullPath := filepath.Join(config.DownloadDirectory, "file.bin"+configs.TEMP_EXT)
+	if err := os.WriteFile(fullPath, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	journalFile, err := writeJournal(journalHeader{
+		DownloaderId:       downloaderId,
+		Url:                "http://localhost/file.bin",
+		FileName:           "file.bin",
+		FileSize:           100,
+		FullPath:           fullPath,
+		SegmentSize:        100,
+		CredentialsDropped: true,
+	}, [][2]int64{{0, 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalFile.Close()
+
+	if _, err := RestoreDownloader(downloaderId); !errors.Is(err, utils.CredentialsMissing) {
+		t.Fatalf("got %v, want CredentialsMissing", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.TempDirectory, downloaderId.String())); !os.IsNotExist(err) {
+		t.Fatalf("journal of the dropped download kept: %v", err)
+	}
+	if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+		t.Fatalf("partial file of the dropped download kept: %v", err)
+	}
+}
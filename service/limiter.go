@@ -0,0 +1,69 @@
+package service
+
+import (
+	"sync"
+)
+
+// limiter is a counting semaphore whose capacity can be changed while it is
+// in use, lowering the capacity never interrupts holders it only blocks new
+// acquires until enough of them release
+type limiter struct {
+	capacity int
+	inUse    int
+	mutex    *sync.Mutex
+	cond     *sync.Cond
+}
+
+func newLimiter(capacity int) *limiter {
+	var mutex sync.Mutex
+	return &limiter{
+		capacity: max(capacity, 1),
+		mutex:    &mutex,
+		cond:     sync.NewCond(&mutex),
+	}
+}
+
+// acquire blocks until a slot is free, it returns false without taking a slot
+// once cancelled reports true, callers must wake the limiter after cancelling
+func (limiter *limiter) acquire(cancelled func() bool) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	for limiter.inUse >= limiter.capacity {
+		if cancelled() {
+			return false
+		}
+		limiter.cond.Wait()
+	}
+	if cancelled() {
+		return false
+	}
+	limiter.inUse++
+	return true
+}
+
+func (limiter *limiter) release() {
+	limiter.mutex.Lock()
+	limiter.inUse--
+	limiter.mutex.Unlock()
+	limiter.cond.Broadcast()
+}
+
+func (limiter *limiter) setCapacity(capacity int) {
+	limiter.mutex.Lock()
+	limiter.capacity = max(capacity, 1)
+	limiter.mutex.Unlock()
+	limiter.cond.Broadcast()
+}
+
+func (limiter *limiter) getCapacity() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.capacity
+}
+
+// wake lets blocked acquires check their cancel condition again
+func (limiter *limiter) wake() {
+	limiter.mutex.Lock()
+	limiter.mutex.Unlock()
+	limiter.cond.Broadcast()
+}
@@ -0,0 +1,411 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/arun-kushwaha04/DownloadHub/configs"
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+	"github.com/google/uuid"
+)
+
+// Manager keeps track of every download submitted to the server, it runs a
+// limited number of them at once and splits the connection and bandwidth
+// budget between the running ones by priority. A queued download with a
+// higher priority pauses the lowest priority running download when no slot
+// is free, the paused download is queued again and resumes once a slot frees.
+// The schedule of the config changes the global bandwidth or pauses every
+// download depending on the time of the day.
+type Manager struct {
+	downloads map[uuid.UUID]*downloader
+	order     []uuid.UUID
+	queue     []*downloader
+	running   map[uuid.UUID]*downloader // downloads whose StartDownload has not returned
+	mutex     *sync.Mutex
+
+	maxActiveDownloads int
+	maxConnections     int
+	bandwidth          *bandwidth
+	paused             bool          // a schedule window paused every download
+	quit               chan struct{} // closed by Close, stops the schedule
+}
+
+func NewManager() *Manager {
+	manager := &Manager{
+		downloads: make(map[uuid.UUID]*downloader),
+		running:   make(map[uuid.UUID]*downloader),
+		mutex:     &sync.Mutex{},
+		quit:      make(chan struct{}),
+
+		maxActiveDownloads: configs.Get().MaxActiveDownloads,
+		maxConnections:     configs.Get().MaxConnections,
+		bandwidth: newBandwidth(pkg.BandwidthLimits{
+			Global:  configs.Get().Bandwidth,
+			PerHost: configs.Get().HostBandwidth,
+			Hosts:   configs.Get().HostBandwidths,
+		}),
+	}
+	if len(configs.Get().Schedule) > 0 {
+		go manager.runSchedule(configs.Get())
+	}
+	return manager
+}
+
+// Close stops applying the schedule, the downloads are left as they are
+func (manager *Manager) Close() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	select {
+	case <-manager.quit:
+	default:
+		close(manager.quit)
+	}
+}
+
+// Restore queues every download interrupted by a previous run
+func (manager *Manager) Restore() error {
+	downloaders, err := RestoreDownloaders()
+	for _, downloader := range downloaders {
+		manager.add(downloader)
+	}
+	return err
+}
+
+// Submit creates a new download and queues it
+func (manager *Manager) Submit(ctx context.Context, resourceUrl string, downloadType *pkg.DownloadType) (*downloader, error) {
+	downloader, err := CreateDownloader(ctx, resourceUrl, downloadType)
+	if err != nil {
+		return nil, err
+	}
+	manager.add(downloader)
+	return downloader, nil
+}
+
+// SubmitMetalink creates a download from a metalink document and queues it
+func (manager *Manager) SubmitMetalink(ctx context.Context, document io.Reader, downloadType *pkg.DownloadType) (*downloader, error) {
+	metalink, err := utils.ParseMetalink(document)
+	if err != nil {
+		return nil, err
+	}
+	downloader, err := CreateMetalinkDownloader(ctx, metalink, downloadType)
+	if err != nil {
+		return nil, err
+	}
+	manager.add(downloader)
+	return downloader, nil
+}
+
+func (manager *Manager) add(downloader *downloader) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	downloader.bandwidth = manager.bandwidth
+	manager.downloads[downloader.downloaderId] = downloader
+	manager.order = append(manager.order, downloader.downloaderId)
+	manager.enqueue(downloader, false)
+	manager.schedule()
+}
+
+// run downloads the file and hands its slot to the next queued download once
+// it finished, failed or was cancelled
+func (manager *Manager) run(downloader *downloader) {
+	downloader.StartDownload()
+	downloader.finish()
+
+	manager.mutex.Lock()
+	delete(manager.running, downloader.downloaderId)
+	manager.schedule()
+	manager.mutex.Unlock()
+}
+
+// activeDownloads returns the running downloads which are not paused, mutex must be held
+func (manager *Manager) activeDownloads() []*downloader {
+	var active []*downloader
+	for _, downloader := range manager.running {
+		if downloader.GetStatus() != pkg.Paused {
+			active = append(active, downloader)
+		}
+	}
+	return active
+}
+
+// enqueue keeps the queue sorted by priority, downloads of the same priority
+// are queued after each other unless ahead is set, mutex must be held
+func (manager *Manager) enqueue(downloader *downloader, ahead bool) {
+	priority := downloader.GetPriority()
+	i := 0
+	for ; i < len(manager.queue); i++ {
+		queued := manager.queue[i].GetPriority()
+		if queued < priority || (ahead && queued == priority) {
+			break
+		}
+	}
+	manager.queue = slices.Insert(manager.queue, i, downloader)
+}
+
+// preemptionVictim returns the active download with the lowest priority if it
+// is lower than the given priority, mutex must be held
+func (manager *Manager) preemptionVictim(active []*downloader, priority pkg.DownloadPriority) *downloader {
+	var victim *downloader
+	for _, downloader := range active {
+		if victim == nil || downloader.GetPriority() < victim.GetPriority() {
+			victim = downloader
+		}
+	}
+	if victim == nil || victim.GetPriority() >= priority {
+		return nil
+	}
+	return victim
+}
+
+// schedule starts queued downloads while slots are free and no schedule
+// window paused the downloads, mutex must be held
+func (manager *Manager) schedule() {
+	for len(manager.queue) > 0 && !manager.paused {
+		downloader := manager.queue[0]
+
+		active := manager.activeDownloads()
+		if len(active) >= manager.maxActiveDownloads {
+			victim := manager.preemptionVictim(active, downloader.GetPriority())
+			if victim == nil {
+				break
+			}
+			if err := victim.Pause(); err != nil {
+				fmt.Println("Unable to preempt download", victim.downloaderId, err)
+				break
+			}
+			fmt.Println("Download", victim.downloaderId, "preempted by", downloader.downloaderId)
+			manager.enqueue(victim, true)
+			continue
+		}
+		manager.queue = manager.queue[1:]
+
+		if _, ok := manager.running[downloader.downloaderId]; ok {
+			// paused download waiting for a free slot
+			if err := downloader.Resume(); err != nil {
+				fmt.Println("Unable to resume download", downloader.downloaderId, err)
+			}
+			continue
+		}
+		manager.running[downloader.downloaderId] = downloader
+		go manager.run(downloader)
+	}
+	manager.rebalance()
+}
+
+// rebalance splits the connection and bandwidth budget between the active
+// downloads weighted by their priority, mutex must be held
+func (manager *Manager) rebalance() {
+	active := manager.activeDownloads()
+	maxBandwidth := manager.bandwidth.global.getRate()
+	totalWeight := 0
+	for _, downloader := range active {
+		totalWeight += downloader.GetPriority().Weight()
+	}
+	for _, downloader := range active {
+		weight := downloader.GetPriority().Weight()
+		downloader.SetMaxConnections(max(manager.maxConnections*weight/totalWeight, 1))
+		downloader.SetMaxBandwidth(maxBandwidth * float64(weight) / float64(totalWeight))
+	}
+}
+
+// SetBandwidth replaces the global and host limits, running downloads follow
+// them right away
+func (manager *Manager) SetBandwidth(limits pkg.BandwidthLimits) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.bandwidth.setLimits(limits)
+	manager.rebalance()
+}
+
+func (manager *Manager) GetBandwidth() pkg.BandwidthLimits {
+	return manager.bandwidth.getLimits()
+}
+
+// SetDownloadBandwidth limits a single download, 0 removes its limit
+func (manager *Manager) SetDownloadBandwidth(downloaderId uuid.UUID, bandwidthLimit float64) error {
+	downloader, err := manager.Get(downloaderId)
+	if err != nil {
+		return err
+	}
+	downloader.SetBandwidthLimit(bandwidthLimit)
+	return nil
+}
+
+func (manager *Manager) dequeue(downloaderId uuid.UUID) bool {
+	for i, downloader := range manager.queue {
+		if downloader.downloaderId == downloaderId {
+			manager.queue = slices.Delete(manager.queue, i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+func (manager *Manager) Get(downloaderId uuid.UUID) (*downloader, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	downloader, ok := manager.downloads[downloaderId]
+	if !ok {
+		return nil, utils.DownloadNotFound
+	}
+	return downloader, nil
+}
+
+// List returns the downloads in the order they were submitted
+func (manager *Manager) List() []*downloader {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	downloaders := make([]*downloader, 0, len(manager.order))
+	for _, downloaderId := range manager.order {
+		downloaders = append(downloaders, manager.downloads[downloaderId])
+	}
+	return downloaders
+}
+
+// Pause pauses the download and gives its slot to the next queued download
+func (manager *Manager) Pause(downloaderId uuid.UUID) error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	downloader, ok := manager.downloads[downloaderId]
+	if !ok {
+		return utils.DownloadNotFound
+	}
+	if _, ok := manager.running[downloaderId]; ok && manager.dequeue(downloaderId) {
+		// preempted download stays paused instead of waiting for a slot
+		return nil
+	}
+	if err := downloader.Pause(); err != nil {
+		return err
+	}
+	manager.schedule()
+	return nil
+}
+
+// Resume resumes the download right away when a slot is free, otherwise the
+// download stays paused in the queue until one is
+func (manager *Manager) Resume(downloaderId uuid.UUID) error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	downloader, ok := manager.downloads[downloaderId]
+	if !ok {
+		return utils.DownloadNotFound
+	}
+	if downloader.GetStatus() != pkg.Paused {
+		return utils.DownloadNotPaused
+	}
+	if _, ok := manager.running[downloaderId]; !ok {
+		// paused before it was started, it keeps its place in the queue
+		return downloader.Resume()
+	}
+	if slices.Contains(manager.queue, downloader) {
+		return nil
+	}
+	manager.enqueue(downloader, true)
+	manager.schedule()
+	return nil
+}
+
+func (manager *Manager) Cancel(downloaderId uuid.UUID) error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	downloader, ok := manager.downloads[downloaderId]
+	if !ok {
+		return utils.DownloadNotFound
+	}
+	return manager.cancel(downloader)
+}
+
+// cancel stops the download, files of a download that never started are
+// removed here as StartDownload will not run, mutex must be held
+func (manager *Manager) cancel(downloader *downloader) error {
+	if err := downloader.Cancel(); err != nil {
+		return err
+	}
+	manager.dequeue(downloader.downloaderId)
+	if _, ok := manager.running[downloader.downloaderId]; !ok {
+		downloader.removeCancelledFiles()
+		downloader.finish()
+	}
+	manager.schedule()
+	return nil
+}
+
+// Verify checks a finished download in the background, the corrupt segments
+// found are queued to be downloaded again
+func (manager *Manager) Verify(downloaderId uuid.UUID) error {
+	downloader, err := manager.Get(downloaderId)
+	if err != nil {
+		return err
+	}
+	if err := downloader.startVerify(); err != nil {
+		return err
+	}
+
+	go func() {
+		if !downloader.Verify() {
+			return
+		}
+		manager.mutex.Lock()
+		defer manager.mutex.Unlock()
+		if _, ok := manager.downloads[downloaderId]; !ok {
+			// removed while it was verified
+			downloader.removeTempFiles()
+			downloader.finish()
+			return
+		}
+		manager.enqueue(downloader, false)
+		manager.schedule()
+	}()
+	return nil
+}
+
+// Remove cancels the download if it is still running and forgets it, the
+// downloaded file is deleted only when deleteFile is set. A download being
+// merged or verified can not be removed until it ended.
+func (manager *Manager) Remove(downloaderId uuid.UUID, deleteFile bool) error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	downloader, ok := manager.downloads[downloaderId]
+	if !ok {
+		return utils.DownloadNotFound
+	}
+
+	switch downloader.GetStatus() {
+	case pkg.Merging, pkg.Verifying:
+		return utils.DownloadBusy
+	case pkg.Completed, pkg.ChecksumMismatch:
+		if deleteFile {
+			if err := os.Remove(downloader.getFullPath()); err != nil && !os.IsNotExist(err) {
+				fmt.Println("Unable to delete file", err)
+				return utils.NewError(utils.FileWritePermissionError, err)
+			}
+		}
+	case pkg.Failed, pkg.Cancelled:
+		// the journal is removed as well so the download is not restored on restart
+		downloader.removeDownloadFiles()
+	default:
+		// cancel removes the partial file along with the journal, the download
+		// is kept when it could not be stopped
+		if err := manager.cancel(downloader); err != nil {
+			return err
+		}
+	}
+
+	delete(manager.downloads, downloaderId)
+	manager.order = slices.DeleteFunc(manager.order, func(id uuid.UUID) bool {
+		return id == downloaderId
+	})
+	return nil
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+func TestRemoveKeepsBusyDownloads(t *testing.T) {
+	setTestConfig(t)
+	server := newTestServer(t, randomData(t, 1024*1024))
+	client := NewClient()
+	t.Cleanup(client.Close)
+
+	download, err := client.NewDownload(server.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	downloaderId := download.downloader.downloaderId
+
+	for _, status := range []pkg.DownloadStatus{pkg.Merging, pkg.Verifying} {
+		download.downloader.setStatus(status)
+		if err := client.manager.Remove(downloaderId, false); !errors.Is(err, utils.DownloadBusy) {
+			t.Fatalf("%s: remove returned %v", status, err)
+		}
+		if _, err := client.manager.Get(downloaderId); err != nil {
+			t.Fatalf("%s: download was forgotten: %v", status, err)
+		}
+	}
+
+	download.downloader.setStatus(pkg.Completed)
+	if err := client.manager.Remove(downloaderId, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.manager.Get(downloaderId); !errors.Is(err, utils.DownloadNotFound) {
+		t.Fatalf("removed download still found: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// a mirror is dropped when it is this many times slower than the fastest one
+const slowMirrorRatio = 4
+
+// samples needed before a mirror is judged slow
+const mirrorSamples = 3
+
+// mirror is one url serving the file, its speed is measured per connection
+// from the chunks it served
+type mirror struct {
+	url     *url.URL
+	speed   float64 // bytes per second of one connection
+	samples int
+	active  int // threads downloading from the mirror
+	dropped bool
+}
+
+// mirrorSet spreads the threads of a download over its mirrors, a faster
+// mirror gets more connections. A mirror which fails or is much slower than
+// the others is dropped and the chunks are downloaded from the remaining ones.
+type mirrorSet struct {
+	mirrors []*mirror
+	mutex   *sync.Mutex
+}
+
+func newMirrorSet(urls []*url.URL) *mirrorSet {
+	set := &mirrorSet{mutex: &sync.Mutex{}}
+	for _, mirrorUrl := range urls {
+		set.mirrors = append(set.mirrors, &mirror{url: mirrorUrl})
+	}
+	return set
+}
+
+// resolveMirrors checks every mirror against the resource, a mirror must
+// support ranges and agree on the size and ETag to be used. ETags are not
+// compared when pieces verify the content, they differ between servers.
+func resolveMirrors(ctx context.Context, resourceInfo *pkg.ResourceInfo, downloadPrt pkg.DownloadSpeed) []*url.URL {
+	var resolved []*url.URL
+	if !resourceInfo.Resumeable {
+		return nil
+	}
+	checkETag := downloadPrt.GetPieces() == nil
+	for _, mirrorUrl := range downloadPrt.GetMirrors() {
+		parsedUrl, err := url.Parse(mirrorUrl)
+		if err != nil {
+			fmt.Println("Ignoring mirror", mirrorUrl, err)
+			continue
+		}
+		mirrorInfo, err := utils.GetMetaData(ctx, mirrorUrl, utils.ScopeHeaders(downloadPrt.GetHeaders(), resourceInfo.Url, parsedUrl))
+		if err != nil {
+			fmt.Println("Ignoring mirror", mirrorUrl, err)
+			continue
+		}
+		mirrorInfo.Client.CloseIdleConnections()
+		if !mirrorInfo.Resumeable || mirrorInfo.FileSize != resourceInfo.FileSize {
+			fmt.Println("Ignoring mirror", mirrorUrl, "size or range support differs")
+			continue
+		}
+		if checkETag && mirrorInfo.ETag != "" && resourceInfo.ETag != "" && mirrorInfo.ETag != resourceInfo.ETag {
+			fmt.Println("Ignoring mirror", mirrorUrl, "ETag differs")
+			continue
+		}
+		resolved = append(resolved, mirrorInfo.FinalUrl)
+	}
+	return resolved
+}
+
+// acquire returns the healthy mirror with the fewest connections for its speed
+func (set *mirrorSet) acquire() *mirror {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	// unmeasured mirrors are assumed as fast as the fastest one
+	fastest := 1.0
+	for _, mirror := range set.mirrors {
+		if !mirror.dropped && mirror.samples > 0 {
+			fastest = max(fastest, mirror.speed)
+		}
+	}
+
+	var picked *mirror
+	var pickedLoad float64
+	for _, mirror := range set.mirrors {
+		if mirror.dropped {
+			continue
+		}
+		speed := fastest
+		if mirror.samples > 0 {
+			speed = max(mirror.speed, 1)
+		}
+		load := float64(mirror.active+1) / speed
+		if picked == nil || load < pickedLoad {
+			picked = mirror
+			pickedLoad = load
+		}
+	}
+	if picked == nil {
+		// every mirror was dropped, the first one is used as the last resort
+		picked = set.mirrors[0]
+	}
+	picked.active++
+	return picked
+}
+
+// release measures the speed of the mirror from a finished chunk
+func (set *mirrorSet) release(mirror *mirror, written int64, elapsed time.Duration) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	mirror.active--
+	if written <= 0 || elapsed <= 0 {
+		return
+	}
+	speed := float64(written) / elapsed.Seconds()
+	if mirror.samples == 0 {
+		mirror.speed = speed
+	} else {
+		mirror.speed = 0.7*mirror.speed + 0.3*speed
+	}
+	mirror.samples++
+
+	if mirror.dropped || mirror.samples < mirrorSamples {
+		return
+	}
+	for _, other := range set.mirrors {
+		if other != mirror && !other.dropped && other.samples >= mirrorSamples && mirror.speed*slowMirrorRatio < other.speed {
+			set.dropLocked(mirror, fmt.Sprintf("%.0f B/s is too slow", mirror.speed))
+			return
+		}
+	}
+}
+
+// drop stops using a mirror after an error, it returns false when no other
+// mirror is left to download from
+func (set *mirrorSet) drop(mirror *mirror, err error) bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return set.dropLocked(mirror, err.Error())
+}
+
+func (set *mirrorSet) dropLocked(mirror *mirror, reason string) bool {
+	if mirror.dropped {
+		return true
+	}
+	if set.healthy() <= 1 {
+		return false
+	}
+	fmt.Println("Dropping mirror", mirror.url.String(), reason)
+	mirror.dropped = true
+	return true
+}
+
+// healthy returns the number of mirrors still in use, mutex must be held
+func (set *mirrorSet) healthy() int {
+	count := 0
+	for _, mirror := range set.mirrors {
+		if !mirror.dropped {
+			count++
+		}
+	}
+	return count
+}
+
+// getUrls returns the urls of the mirrors still in use
+func (set *mirrorSet) getUrls() []string {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	var urls []string
+	for _, mirror := range set.mirrors {
+		if !mirror.dropped {
+			urls = append(urls, mirror.url.String())
+		}
+	}
+	return urls
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// a piece failing more often than this fails the download
+const maxPieceRetries = 3
+
+// checkPieces hashes the pieces of a completed segment, the ranges of corrupt
+// pieces are given back to be downloaded again. It returns true when a piece
+// has to be downloaded again.
+func (segment *Segment) checkPieces() bool {
+	pieces := segment.downloader.pieces
+	if pieces == nil || !segment.isCompleted() {
+		return false
+	}
+
+	retry := false
+	hasher := utils.NewHash(pieces.Algorithm)
+	for start := segment.segmentStart; start < segment.segmentEnd; start += pieces.Length {
+		end := min(start+pieces.Length, segment.segmentEnd)
+		piece := start / pieces.Length
+
+		hasher.Reset()
+		_, err := io.Copy(hasher, io.NewSectionReader(segment.file, segment.fileOffset+start-segment.segmentStart, end-start))
+		if err == nil && bytes.Equal(hasher.Sum(nil), pieces.Hashes[piece]) {
+			continue
+		}
+
+		segment.pieceFailures[piece]++
+		if segment.pieceFailures[piece] > maxPieceRetries {
+			fmt.Println("Piece", piece, "is still corrupt after", maxPieceRetries, "downloads")
+			segment.errorChan <- utils.NewError(utils.PieceMismatch, nil).InSegment(segment.segmentId, [2]int64{start, end})
+			return false
+		}
+		fmt.Println("Piece", piece, "is corrupt, downloading it again")
+		segment.giveBack([2]int64{start, end})
+		retry = true
+	}
+	return retry
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/configs"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// newStatusError is the error of a status code the server answered a range request with
+func newStatusError(res *http.Response) *utils.DownloadError {
+	return utils.NewError(utils.ServerError, nil).WithStatus(res.StatusCode, parseRetryAfter(res.Header.Get("Retry-After")))
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// isRetriable reports whether a request failing with err may succeed when
+// sent again. Timeouts, stalls, dropped or refused connections, unreachable
+// hosts, 5xx, 408 and 429 are retried, other status codes such as 404 or 410,
+// other connection errors and a full disk are fatal.
+func isRetriable(err error) bool {
+	var downloadErr *utils.DownloadError
+	if errors.As(err, &downloadErr) && downloadErr.StatusCode != 0 {
+		return downloadErr.StatusCode == http.StatusRequestTimeout ||
+			downloadErr.StatusCode == http.StatusTooManyRequests ||
+			downloadErr.StatusCode >= http.StatusInternalServerError
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return false
+	}
+	if errors.Is(err, utils.ReadTimeout) ||
+		errors.Is(err, utils.ConnectionStalled) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTUNREACH) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// a connection lost while a range was sent or read is opened again, one
+	// failing to open for another reason such as a bad address is not
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "read" || opErr.Op == "write")
+}
+
+// retryPolicy decides how often a failed range is requested again and how
+// long the thread waits before. The delay doubles with every attempt up to
+// the maximum and half of it is random, so threads failing together do not
+// retry together. A delay asked for with Retry-After is never cut short.
+type retryPolicy struct {
+	attempts int
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+func newRetryPolicy(config *configs.Config) retryPolicy {
+	return retryPolicy{
+		attempts: config.RetryAttempts,
+		delay:    time.Duration(config.RetryDelay) * time.Millisecond,
+		maxDelay: time.Duration(config.RetryMaxDelay) * time.Millisecond,
+	}
+}
+
+// backoff returns the wait before the given attempt, the first attempt is 1
+func (policy retryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	delay := policy.delay
+	for i := 1; i < attempt && delay < policy.maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, policy.maxDelay)
+	if delay > 0 {
+		delay = delay/2 + rand.N(delay/2+1)
+	}
+	return max(delay, retryAfter)
+}
+
+// retryDelay counts a failed attempt of the range starting at offset and
+// returns how long to wait before it is requested again. It returns false
+// when the error is fatal or the range failed too often, a range which
+// failed after making progress starts counting again.
+func (segment *Segment) retryDelay(offset int64, err error) (time.Duration, bool) {
+	if !isRetriable(err) {
+		return 0, false
+	}
+	policy := segment.downloader.retryPolicy
+
+	segment.threadMutex.Lock()
+	defer segment.threadMutex.Unlock()
+	attempt := segment.retries[offset] + 1
+	if attempt > policy.attempts {
+		return 0, false
+	}
+	segment.retries[offset] = attempt
+
+	var retryAfter time.Duration
+	var downloadErr *utils.DownloadError
+	if errors.As(err, &downloadErr) {
+		retryAfter = downloadErr.RetryAfter
+	}
+	return policy.backoff(attempt, retryAfter), true
+}
+
+// retry waits before the range of a failed thread is requested again from
+// offset, where the thread stopped. After a fatal error or once the range
+// failed too often the mirror is dropped and the range moves to another
+// mirror with a new count of attempts, without another mirror the segment
+// stops.
+func (thread *thread) retry(err error, offset int64, stopped chan struct{}) {
+	delay, ok := thread.segment.retryDelay(offset, err)
+	if ok {
+		utils.PrintToTerminal(fmt.Sprintf("Retrying in %s after %s", delay.Round(time.Millisecond), err), thread.segment.segmentId, thread.threadId, false)
+		thread.wait(delay, stopped)
+		return
+	}
+	if thread.segment.downloader.mirrors.drop(thread.mirror, err) {
+		thread.segment.resetRetries(offset)
+		return
+	}
+	thread.segment.errorChan <- thread.newError(err)
+}
+
+// resetRetries forgets the failed attempts of the range starting at offset
+func (segment *Segment) resetRetries(offset int64) {
+	segment.threadMutex.Lock()
+	delete(segment.retries, offset)
+	segment.threadMutex.Unlock()
+}
+
+// newError locates err at the range of the thread, errors not coming from the
+// server are request errors
+func (thread *thread) newError(err error) error {
+	var downloadErr *utils.DownloadError
+	if !errors.As(err, &downloadErr) {
+		switch {
+		case errors.Is(err, utils.ReadTimeout), errors.Is(err, utils.ConnectionStalled):
+			downloadErr = utils.NewError(err, nil)
+		default:
+			downloadErr = utils.NewError(utils.HttpRequestError, err)
+		}
+	}
+	return downloadErr.InThread(thread.segment.segmentId, thread.threadId, [2]int64{thread.startByte, thread.getEndByte()})
+}
+
+// wait sleeps until the delay passed or the thread is stopped, the time is
+// not counted against the speed of the mirror
+func (thread *thread) wait(delay time.Duration, stopped chan struct{}) {
+	start := time.Now()
+	defer func() { thread.waited += time.Since(start) }()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stopped:
+	}
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// timeoutError is a net.Error reporting a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetriable(t *testing.T) {
+	status := func(code int) error {
+		return utils.NewError(utils.ServerError, nil).WithStatus(code, 0)
+	}
+	opError := func(op string, err error) error {
+		return &url.Error{Op: "Get", URL: "http://localhost/file.bin", Err: &net.OpError{Op: op, Net: "tcp", Err: err}}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"not found", status(http.StatusNotFound), false},
+		{"gone", status(http.StatusGone), false},
+		{"forbidden", status(http.StatusForbidden), false},
+		{"request timeout", status(http.StatusRequestTimeout), true},
+		{"too many requests", status(http.StatusTooManyRequests), true},
+		{"internal server error", status(http.StatusInternalServerError), true},
+		{"service unavailable", status(http.StatusServiceUnavailable), true},
+		{"read timeout", utils.ReadTimeout, true},
+		{"stalled", utils.ConnectionStalled, true},
+		{"short body", utils.NewError(utils.HttpRequestError, io.ErrUnexpectedEOF), true},
+		{"connection reset", opError("read", os.NewSyscallError("read", syscall.ECONNRESET)), true},
+		{"connection refused", opError("dial", os.NewSyscallError("connect", syscall.ECONNREFUSED)), true},
+		{"host unreachable", opError("dial", os.NewSyscallError("connect", syscall.EHOSTUNREACH)), true},
+		{"connection lost while reading", opError("read", errors.New("use of closed network connection")), true},
+		{"dial permission denied", opError("dial", os.NewSyscallError("socket", syscall.EACCES)), false},
+		{"bad address", opError("dial", &net.AddrError{Err: "missing port in address", Addr: "localhost"}), false},
+		{"timeout", &url.Error{Op: "Get", URL: "http://localhost", Err: timeoutError{}}, true},
+		{"dns timeout", &net.DNSError{Err: "timeout", Name: "localhost", IsTimeout: true}, true},
+		{"dns not found", &net.DNSError{Err: "no such host", Name: "nowhere.invalid", IsNotFound: true}, false},
+		{"disk full", utils.NewError(utils.NoEnoughSpace, syscall.ENOSPC), false},
+		{"other", errors.New("unsupported protocol scheme"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetriable(test.err); got != test.want {
+				t.Fatalf("isRetriable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"empty", "", 0, 0},
+		{"seconds", "120", 120 * time.Second, 120 * time.Second},
+		{"zero", "0", 0, 0},
+		{"negative", "-5", 0, 0},
+		{"garbage", "soon", 0, 0},
+		{"future date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 58 * time.Minute, time.Hour},
+		{"past date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseRetryAfter(test.value); got < test.min || got > test.max {
+				t.Fatalf("parseRetryAfter(%q) = %s, want between %s and %s", test.value, got, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestRetryDropsMirrorAfterAttempts(t *testing.T) {
+	first, _ := url.Parse("http://first.example.com/file.bin")
+	second, _ := url.Parse("http://second.example.com/file.bin")
+	mirrors := newMirrorSet([]*url.URL{first, second})
+	segment := &Segment{
+		downloader:  &downloader{mirrors: mirrors, retryPolicy: retryPolicy{attempts: 2}},
+		threadMutex: &sync.Mutex{},
+		retries:     make(map[int64]int),
+		errorChan:   make(chan error, 1),
+	}
+	thread := &thread{segment: segment, mirror: mirrors.mirrors[0], mutex: &sync.Mutex{}}
+	unavailable := utils.NewError(utils.ServerError, nil).WithStatus(http.StatusServiceUnavailable, 0)
+
+	// transient errors are retried on the same mirror until the attempts are used
+	for range 2 {
+		thread.retry(unavailable, 0, make(chan struct{}))
+		if mirrors.mirrors[0].dropped {
+			t.Fatalf("mirror dropped after %d attempts", segment.retries[0])
+		}
+	}
+	thread.retry(unavailable, 0, make(chan struct{}))
+	if !mirrors.mirrors[0].dropped {
+		t.Fatal("mirror kept after the attempts were used")
+	}
+	if segment.retries[0] != 0 {
+		t.Fatalf("the other mirror starts with %d attempts", segment.retries[0])
+	}
+
+	// a fatal error on the last mirror stops the segment
+	thread.mirror = mirrors.mirrors[1]
+	thread.retry(utils.NewError(utils.ServerError, nil).WithStatus(http.StatusNotFound, 0), 0, make(chan struct{}))
+	if mirrors.mirrors[1].dropped {
+		t.Fatal("the last mirror was dropped")
+	}
+	select {
+	case err := <-segment.errorChan:
+		if !errors.Is(err, utils.ServerError) {
+			t.Fatalf("segment stopped with %v", err)
+		}
+	default:
+		t.Fatal("segment not stopped by the fatal error")
+	}
+}
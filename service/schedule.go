@@ -0,0 +1,68 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/configs"
+)
+
+// how often the manager looks for a schedule window opening or closing
+const scheduleInterval = 30 * time.Second
+
+// runSchedule applies the schedule of the config whenever the open window
+// changes, it returns once the manager is closed
+func (manager *Manager) runSchedule(config *configs.Config) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	window := -1
+	for {
+		active := config.ActiveWindow(time.Now())
+		if active != window {
+			window = active
+			if active == -1 {
+				fmt.Println("Schedule window closed")
+				manager.applySchedule(nil)
+			} else {
+				fmt.Println("Schedule window", config.Schedule[active].String(), "opened")
+				manager.applySchedule(&config.Schedule[active])
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-manager.quit:
+			return
+		}
+	}
+}
+
+// applySchedule replaces the global bandwidth with the one of the window or
+// pauses every download while the window is a paused one. The downloads
+// paused by a window are queued first and resume once it closes, nil
+// restores the limits set outside of windows.
+func (manager *Manager) applySchedule(window *configs.ScheduleWindow) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if window != nil && !window.Paused {
+		rate := window.Bandwidth
+		manager.bandwidth.setScheduled(&rate)
+	} else {
+		manager.bandwidth.setScheduled(nil)
+	}
+
+	manager.paused = window != nil && window.Paused
+	if manager.paused {
+		for _, downloader := range manager.activeDownloads() {
+			if err := downloader.Pause(); err != nil {
+				fmt.Println("Unable to pause download", downloader.downloaderId, err)
+				continue
+			}
+			fmt.Println("Download", downloader.downloaderId, "paused by the schedule")
+			manager.enqueue(downloader, true)
+		}
+	}
+	manager.schedule()
+}
@@ -2,8 +2,10 @@ package service
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
@@ -17,6 +19,7 @@ type Segment struct {
 	segmentStart int64
 	segmentEnd   int64
 	segmentPath  string
+	fileOffset   int64 // position of segmentStart in the file at segmentPath
 
 	waitGroup *sync.WaitGroup
 
@@ -29,7 +32,7 @@ type Segment struct {
 	completedChunks     [][2]int64 // need to restore download when pause due to less bandwidh
 	completedChunkMutex *sync.Mutex
 
-	maxThreads   uint8
+	maxThreads   uint8 // ceiling of the thread count chosen by the tuner
 	maxChunkSize int64
 
 	file        *os.File
@@ -38,21 +41,79 @@ type Segment struct {
 
 	errorChan   chan error
 	controlChan chan uint8
+	stopped     bool
+
+	pieceFailures map[int64]int
+	retries       map[int64]int // failed attempts of the range starting at an offset
 
 	downloader *downloader
 }
 
+const (
+	controlPause uint8 = iota + 1
+	controlCancel
+)
+
+var defaultSegmentThreads uint8 = 2
+
 func (segment *Segment) addThread(thread *thread) {
 	segment.threadMutex.Lock()
 	segment.threads[thread.threadId] = thread
+	if segment.stopped {
+		thread.stop()
+	}
 	segment.threadMutex.Unlock()
 }
 
 func (segment *Segment) removeThread(threadId uint8, downloadedChunk [2]int64) {
 	segment.threadMutex.Lock()
-	segment.montiorChunkDownload(downloadedChunk)
 	delete(segment.threads, threadId)
 	segment.threadMutex.Unlock()
+	if downloadedChunk[1] > downloadedChunk[0] {
+		segment.montiorChunkDownload(downloadedChunk)
+	}
+}
+
+// stop sends a control signal to the segment, it never blocks
+func (segment *Segment) stop(signal uint8) {
+	select {
+	case segment.controlChan <- signal:
+	default:
+	}
+}
+
+func (segment *Segment) syncFile() {
+	segment.threadMutex.Lock()
+	defer segment.threadMutex.Unlock()
+	if segment.file != nil {
+		segment.file.Sync()
+	}
+}
+
+// getMaxThreads returns the threads the segment may run now
+func (segment *Segment) getMaxThreads() int {
+	return min(int(segment.maxThreads), segment.downloader.tuner.getThreads())
+}
+
+func (segment *Segment) isStopped() bool {
+	segment.threadMutex.Lock()
+	defer segment.threadMutex.Unlock()
+	return segment.stopped
+}
+
+// listenControl stops every running thread once a control signal arrives
+func (segment *Segment) listenControl(done chan struct{}) {
+	select {
+	case <-segment.controlChan:
+		segment.threadMutex.Lock()
+		segment.stopped = true
+		for _, thread := range segment.threads {
+			thread.stop()
+		}
+		segment.threadMutex.Unlock()
+		segment.downloader.connectionLimiter.wake()
+	case <-done:
+	}
 }
 
 func (segment *Segment) requestChunk() [2]int64 {
@@ -78,131 +139,315 @@ func (segment *Segment) requestChunk() [2]int64 {
 	return chunk
 }
 
+// hasMissingChunk reports whether a range of the segment was never requested
+// or was given back
+func (segment *Segment) hasMissingChunk() bool {
+	segment.requestedMutex.Lock()
+	defer segment.requestedMutex.Unlock()
+	for i := 1; i < len(segment.requested); i++ {
+		if segment.requested[i-1][1] != segment.requested[i][0] {
+			return true
+		}
+	}
+	return false
+}
+
 func (segment *Segment) updateChunk(start int64, newEndChunk int64) {
 	segment.requestedMutex.Lock()
+	segment.updateChunkLocked(start, newEndChunk)
+	segment.requestedMutex.Unlock()
+}
+
+// updateChunkLocked changes the end of the requested chunk starting at start,
+// requestedMutex must be held
+func (segment *Segment) updateChunkLocked(start int64, newEndChunk int64) {
 	i := 1
 	for ; i < len(segment.requested); i++ {
 		if segment.requested[i][0] == start {
 			break
 		}
 	}
+	if newEndChunk == start {
+		// an empty chunk would share its start with the chunk requested next
+		segment.requested = slices.Delete(segment.requested, i, i+1)
+		return
+	}
 	segment.requested[i][1] = newEndChunk
-	segment.requestedMutex.Unlock()
 }
 
-func (segment *Segment) montiorChunkDownload(downloadedChunk [2]int64) {
-	i := 0
-	for ; i < len(segment.completedChunks); i++ {
-		if segment.completedChunks[i][0] >= downloadedChunk[1] {
-			break
+// steal splits the range of the running thread expected to finish last, the
+// second half is marked as requested and returned. It returns {-1, -1} when
+// no range is long enough to be split.
+func (segment *Segment) steal() [2]int64 {
+	if segment.downloader.isSingleStream() {
+		return [2]int64{-1, -1}
+	}
+
+	segment.threadMutex.Lock()
+	var slowest *thread
+	var slowestTime float64
+	for _, thread := range segment.threads {
+		if remainingTime := thread.remainingTime(); slowest == nil || remainingTime > slowestTime {
+			slowest = thread
+			slowestTime = remainingTime
 		}
-		if segment.completedChunks[i][1] == downloadedChunk[0] {
-			i++
+	}
+	segment.threadMutex.Unlock()
+	if slowest == nil {
+		return [2]int64{-1, -1}
+	}
+
+	// the chunk of the thread is cut and the stolen half marked together so
+	// requestChunk never sees the half as missing
+	segment.requestedMutex.Lock()
+	defer segment.requestedMutex.Unlock()
+	stolen, ok := slowest.split()
+	if !ok {
+		return [2]int64{-1, -1}
+	}
+	segment.updateChunkLocked(slowest.startByte, stolen[0])
+	i := 1
+	for ; i < len(segment.requested); i++ {
+		if segment.requested[i][0] > stolen[0] {
 			break
 		}
 	}
-	if i == 0 {
-		// starting chunk
-		segment.completedChunks = append([][2]int64{downloadedChunk}, segment.completedChunks[0:]...)
-	} else if i == len(segment.completedChunks) {
-		segment.completedChunks = append(segment.completedChunks, downloadedChunk)
-	} else {
-		segment.completedChunks = append(segment.completedChunks[:i], segment.completedChunks[i-1:]...)
-		segment.completedChunks[i] = downloadedChunk
+	segment.requested = slices.Insert(segment.requested, i, stolen)
+	return stolen
+}
+
+// montiorChunkDownload records a downloaded byte range, completedChunks is kept
+// sorted with adjacent ranges merged together
+func (segment *Segment) montiorChunkDownload(downloadedChunk [2]int64) {
+	segment.completedChunkMutex.Lock()
+	segment.completedChunks = mergeChunk(segment.completedChunks, downloadedChunk)
+	segment.completedChunkMutex.Unlock()
+}
+
+func (segment *Segment) getCompletedChunks() [][2]int64 {
+	segment.completedChunkMutex.Lock()
+	defer segment.completedChunkMutex.Unlock()
+	chunks := make([][2]int64, len(segment.completedChunks))
+	copy(chunks, segment.completedChunks)
+	return chunks
+}
+
+// setSegmentEnd ends a streamed segment at the last received byte
+func (segment *Segment) setSegmentEnd(segmentEnd int64) {
+	segment.requestedMutex.Lock()
+	segment.requested[len(segment.requested)-1] = [2]int64{segmentEnd, segmentEnd}
+	segment.requestedMutex.Unlock()
+
+	segment.completedChunkMutex.Lock()
+	segment.segmentEnd = segmentEnd
+	segment.completedChunkMutex.Unlock()
+}
+
+func (segment *Segment) getSegmentEnd() int64 {
+	segment.completedChunkMutex.Lock()
+	defer segment.completedChunkMutex.Unlock()
+	return segment.segmentEnd
+}
+
+func (segment *Segment) isCompleted() bool {
+	segment.completedChunkMutex.Lock()
+	defer segment.completedChunkMutex.Unlock()
+	if segment.segmentEnd == segment.segmentStart {
+		// an empty stream
+		return true
+	}
+	return len(segment.completedChunks) == 1 &&
+		segment.completedChunks[0][0] <= segment.segmentStart &&
+		segment.completedChunks[0][1] >= segment.segmentEnd
+}
+
+// giveBack marks a downloaded range as missing, no thread may be running
+func (segment *Segment) giveBack(chunk [2]int64) {
+	segment.completedChunkMutex.Lock()
+	segment.completedChunks = removeChunk(segment.completedChunks, chunk)
+	completedChunks := make([][2]int64, len(segment.completedChunks))
+	copy(completedChunks, segment.completedChunks)
+	segment.completedChunkMutex.Unlock()
+
+	segment.requestedMutex.Lock()
+	segment.requested = append([][2]int64{{segment.segmentStart - 1, segment.segmentStart}}, completedChunks...)
+	segment.requested = append(segment.requested, [2]int64{segment.segmentEnd, segment.segmentEnd})
+	segment.requestedMutex.Unlock()
+}
+
+// removeChunk cuts a range out of sorted chunks
+func removeChunk(chunks [][2]int64, chunk [2]int64) [][2]int64 {
+	var remaining [][2]int64
+	for _, c := range chunks {
+		if c[1] <= chunk[0] || c[0] >= chunk[1] {
+			remaining = append(remaining, c)
+			continue
+		}
+		if c[0] < chunk[0] {
+			remaining = append(remaining, [2]int64{c[0], chunk[0]})
+		}
+		if c[1] > chunk[1] {
+			remaining = append(remaining, [2]int64{chunk[1], c[1]})
+		}
+	}
+	return remaining
+}
+
+func mergeChunk(chunks [][2]int64, chunk [2]int64) [][2]int64 {
+	merged := make([][2]int64, 0, len(chunks)+1)
+	i := 0
+	for ; i < len(chunks) && chunks[i][1] < chunk[0]; i++ {
+		merged = append(merged, chunks[i])
 	}
+	for ; i < len(chunks) && chunks[i][0] <= chunk[1]; i++ {
+		chunk[0] = min(chunk[0], chunks[i][0])
+		chunk[1] = max(chunk[1], chunks[i][1])
+	}
+	merged = append(merged, chunk)
+	return append(merged, chunks[i:]...)
 }
 
 func (segment *Segment) StartSegment() {
-	// defer segment.downloader.waitGroup.Done()
 	fmt.Println("Start of segment", segment.segmentId)
 	file, err := os.OpenFile(segment.segmentPath, os.O_RDWR, 0644)
 	if err != nil {
 		fmt.Println("Segment", segment.segmentId, "file open error")
-		segment.downloader.errorChan <- err
+		kind := utils.FileWritePermissionError
+		if os.IsNotExist(err) {
+			kind = utils.MissingSegmentFile
+		}
+		segment.downloader.reportError(utils.NewError(kind, err).InSegment(segment.segmentId, [2]int64{segment.segmentStart, segment.getSegmentEnd()}))
 		return
 	}
+	segment.threadMutex.Lock()
 	segment.file = file
-	defer file.Close()
-
-	// go func() {
-	// 	// code stuck here until channel closes
-	// 	for i := range segment.controlChan {
-	// 		if i == 1 {
-	// 			for i := range segment.threads {
-	// 				segment.threads[i].controlChan <- 1
-	// 				close(segment.threads[i].controlChan)
-	// 			}
-	// 			segment.errorChan <- nil
-	// 			file.Close()
-	// 		}
-	// 	}
-	// }()
+	segment.threadMutex.Unlock()
+	defer func() {
+		// journaled ranges must be on disk before the file is closed
+		segment.threadMutex.Lock()
+		file.Sync()
+		file.Close()
+		segment.file = nil
+		segment.threadMutex.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go segment.listenControl(done)
 
+	forwarded := make(chan struct{})
 	go func() {
+		defer close(forwarded)
 		for err := range segment.errorChan {
 			if err != nil {
-				segment.downloader.errorChan <- err
-				return
+				// a failed thread stops the segment, progress so far is kept
+				segment.stop(controlCancel)
+				segment.downloader.reportError(err)
 			}
 		}
 	}()
 
-	limiter := make(chan uint8, segment.maxThreads)
+	// the thread count follows the tuner, lowering it lets running threads finish
+	limiter := newLimiter(segment.getMaxThreads())
 	var i uint8 = 0
 	for {
+		limiter.setCapacity(segment.getMaxThreads())
+		if !limiter.acquire(segment.isStopped) {
+			break
+		}
+		if !segment.downloader.connectionLimiter.acquire(segment.isStopped) {
+			break
+		}
 		chunk := segment.requestChunk()
 		if chunk[1] == -1 {
-			break
+			// nothing left to request, the idle connection takes over the
+			// end of the slowest range
+			chunk = segment.steal()
+		}
+		if chunk[1] == -1 {
+			segment.downloader.connectionLimiter.release()
+			limiter.release()
+			// a thread dropping its mirror gives its range back, it is
+			// requested again once the running threads exited
+			segment.waitGroup.Wait()
+			if !segment.hasMissingChunk() && !segment.checkPieces() {
+				break
+			}
+			continue
 		}
 
 		segment.waitGroup.Add(1)
-		limiter <- 1
 		go func(i uint8) {
-			var controlChan chan uint8
+			// the range is recorded before the segment stops waiting for the thread
+			defer segment.waitGroup.Done()
+			defer segment.downloader.connectionLimiter.release()
 			thread := &thread{
 				threadId:    i,
 				startTime:   time.Now(),
 				startByte:   chunk[0],
 				endByte:     chunk[1],
 				segment:     segment,
-				controlChan: controlChan,
+				mirror:      segment.downloader.mirrors.acquire(),
+				controlChan: make(chan uint8, 1),
+				mutex:       &sync.Mutex{},
 			}
 			segment.addThread(thread)
-			thread.StartThread()
-			segment.removeThread(i, chunk)
-			<-limiter
+			written := thread.StartThread()
+			segment.downloader.mirrors.release(thread.mirror, written, time.Since(thread.startTime)-thread.waited)
+			if chunk[0]+written < thread.getEndByte() {
+				// release the part of the chunk that was not downloaded
+				segment.updateChunk(chunk[0], chunk[0]+written)
+			}
+			segment.removeThread(i, [2]int64{chunk[0], chunk[0] + written})
+			limiter.release()
 		}(i)
 		i++
 	}
 
 	segment.waitGroup.Wait()
 	close(segment.errorChan)
+	<-forwarded
 	utils.PrintToTerminal("Segment downloaded", segment.segmentId, 1, false)
 
 	return
 }
 
 func CreateNewSegment(segmentId int64, segmentParentFolder string, downloader *downloader) *Segment {
+	// ranges downloaded before a pause are marked as requested so they are not fetched again
+	completedChunks := downloader.getSegmentProgress(segmentId)
+
+	segmentStart := segmentId * downloader.segmentSize
+	segmentEnd := min(((segmentId + 1) * downloader.segmentSize), downloader.resourceInfo.FileSize)
+	if downloader.streaming {
+		// the end is set once the server closes the response
+		segmentEnd = math.MaxInt64
+	}
 
-	//logic for segment here
-	fileName := strconv.FormatInt(segmentId, 10) + configs.SEG_EXT
-	filePath := path.Join(segmentParentFolder, fileName)
+	// a direct write segment writes its range of the download file, bytes
+	// not journaled are downloaded again so nothing has to be cleared
+	filePath := downloader.fullPath
+	fileOffset := segmentStart
+	if !downloader.directWrite {
+		fileName := strconv.FormatInt(segmentId, 10) + configs.SEG_EXT
+		filePath = path.Join(segmentParentFolder, fileName)
+		fileOffset = 0
 
-	var control chan uint8
-	segmentFileSize, err := utils.FileExits(segmentParentFolder, fileName, true)
+		segmentFileSize, err := utils.FileExits(segmentParentFolder, fileName, true)
 
-	if err != nil {
-		fmt.Println("Unable to get information for segment file", err)
-		return nil
-	}
-	// to think again
-	if segmentFileSize > 0 && segmentFileSize != configs.SEGMENT_SIZE {
-		// delete the old file and create new one
-		err := utils.DeleteAndCreateNewFile(segmentParentFolder, fileName)
 		if err != nil {
-			fmt.Println("Unable to delete file", err)
+			fmt.Println("Unable to get information for segment file", err)
 			return nil
 		}
+
+		// without recorded progress the content of an old segment file can not be trusted
+		if segmentFileSize > 0 && len(completedChunks) == 0 {
+			// delete the old file and create new one
+			err := utils.DeleteAndCreateNewFile(segmentParentFolder, fileName)
+			if err != nil {
+				fmt.Println("Unable to delete file", err)
+				return nil
+			}
+		}
 	}
 
 	var requestMutex sync.Mutex
@@ -210,23 +455,30 @@ func CreateNewSegment(segmentId int64, segmentParentFolder string, downloader *d
 	var completedChunkMutex sync.Mutex
 	waitGroup := &sync.WaitGroup{}
 
-	segmentStart := segmentId * configs.SEGMENT_SIZE
-	segmentEnd := min(((segmentId + 1) * configs.SEGMENT_SIZE), downloader.resourceInfo.FileSize)
-
-	var requested, completedChunks [][2]int64
+	var requested [][2]int64
 	var s = [2]int64{segmentStart - 1, segmentStart}
 	var e = [2]int64{segmentEnd, segmentEnd}
 	requested = append(requested, s)
+	requested = append(requested, completedChunks...)
 	requested = append(requested, e)
 
 	thread := make(map[uint8]*thread)
 	errorChan := make(chan error)
 
+	maxThreads := uint8(downloader.tuner.ceiling)
+	var maxChunkSize int64 = 1024 * 1024
+	if downloader.isSingleStream() {
+		// the whole file is read from one response
+		maxThreads = 1
+		maxChunkSize = segmentEnd - segmentStart
+	}
+
 	return &Segment{
 		segmentId:    segmentId,
 		segmentStart: segmentStart,
 		segmentEnd:   segmentEnd,
 		segmentPath:  filePath,
+		fileOffset:   fileOffset,
 
 		waitGroup: waitGroup,
 
@@ -242,11 +494,14 @@ func CreateNewSegment(segmentId int64, segmentParentFolder string, downloader *d
 		threads:     thread,
 		threadMutex: &threadMutex,
 
-		maxThreads:   2,
-		maxChunkSize: 1024 * 1024,
+		maxThreads:   maxThreads,
+		maxChunkSize: maxChunkSize,
 
 		errorChan:   errorChan,
-		controlChan: control,
+		controlChan: make(chan uint8, 1),
+
+		pieceFailures: make(map[int64]int),
+		retries:       make(map[int64]int),
 
 		downloader: downloader,
 	}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/configs"
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// setTestConfig points the downloads of a test at its own directory
+func setTestConfig(t *testing.T) *configs.Config {
+	t.Helper()
+	dir := t.TempDir()
+	config := configs.Default()
+	config.DownloadDirectory = dir
+	config.TempDirectory = filepath.Join(dir, ".temp")
+	config.SegmentSize = 512 * 1024
+	config.Bandwidth = 0
+	configs.Set(config)
+	return config
+}
+
+// newTestServer serves data with range support at every path
+func newTestServer(t *testing.T, data []byte) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMultiSegmentDownloadCompletes(t *testing.T) {
+	setTestConfig(t)
+	data := randomData(t, 12*1024*1024)
+	server := newTestServer(t, data)
+
+	client := NewClient()
+	for run := range 3 {
+		download, err := client.NewDownload(server.URL+"/file.bin", WithFileName("file"+string(rune('a'+run))+".bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := download.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := download.Wait(); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		info, _ := download.Info()
+		if info.Status != pkg.Completed {
+			t.Fatalf("run %d: status %s", run, info.Status)
+		}
+		got, err := os.ReadFile(info.FullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("run %d: downloaded file differs", run)
+		}
+	}
+}
+
+// rangeServer serves data and records the byte ranges it was asked for
+type rangeServer struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	ranges [][2]int64
+}
+
+func newRangeServer(t *testing.T, data []byte) *rangeServer {
+	t.Helper()
+	server := &rangeServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			server.mutex.Lock()
+			server.ranges = append(server.ranges, [2]int64{start, end + 1})
+			server.mutex.Unlock()
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (server *rangeServer) requested() [][2]int64 {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return slices.Clone(server.ranges)
+}
+
+// waitFor polls condition until it holds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestPauseResumeDownload(t *testing.T) {
+	setTestConfig(t)
+	data := randomData(t, 4*1024*1024)
+	server := newRangeServer(t, data)
+	client := NewClient()
+	t.Cleanup(client.Close)
+
+	download, err := client.NewDownload(server.URL+"/file.bin", WithSpeedLimit(2*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	downloader := download.downloader
+	waitFor(t, "the first bytes", func() bool { return downloader.bytesDownloaded.Load() >= 512*1024 })
+
+	if err := download.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the segments to stop", func() bool {
+		downloader.segmentMutex.Lock()
+		defer downloader.segmentMutex.Unlock()
+		return len(downloader.activeSegments) == 0
+	})
+	if info, _ := download.Info(); info.Status != pkg.Paused {
+		t.Fatalf("status %s, want paused", info.Status)
+	}
+
+	// the ranges on disk when the download was paused
+	var written [][2]int64
+	downloader.segmentMutex.Lock()
+	for segmentId := range downloader.finishedSegments {
+		end := min((segmentId+1)*downloader.segmentSize, int64(len(data)))
+		written = mergeChunk(written, [2]int64{segmentId * downloader.segmentSize, end})
+	}
+	for _, chunks := range downloader.segmentProgress {
+		for _, chunk := range chunks {
+			written = mergeChunk(written, chunk)
+		}
+	}
+	downloader.segmentMutex.Unlock()
+	if len(written) == 0 {
+		t.Fatal("nothing was written before the pause")
+	}
+
+	paused := len(server.requested())
+	time.Sleep(200 * time.Millisecond)
+	if len(server.requested()) != paused {
+		t.Fatal("ranges were requested while paused")
+	}
+
+	if err := download.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := download.Info()
+	got, err := os.ReadFile(info.FullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs")
+	}
+	for _, requested := range server.requested()[paused:] {
+		for _, chunk := range written {
+			if requested[0] < chunk[1] && chunk[0] < requested[1] {
+				t.Fatalf("range %v requested after the resume, %v was written before the pause", requested, chunk)
+			}
+		}
+	}
+}
+
+func TestCancelRemovesFiles(t *testing.T) {
+	config := setTestConfig(t)
+	server := newTestServer(t, randomData(t, 4*1024*1024))
+	client := NewClient()
+	t.Cleanup(client.Close)
+
+	download, err := client.NewDownload(server.URL+"/file.bin", WithSpeedLimit(1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	downloader := download.downloader
+	waitFor(t, "the first bytes", func() bool { return downloader.bytesDownloaded.Load() >= 256*1024 })
+	info, _ := download.Info()
+
+	if err := download.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Wait(); !errors.Is(err, utils.DownloadCancelled) {
+		t.Fatalf("wait returned %v, want DownloadCancelled", err)
+	}
+	for _, leftover := range []string{
+		info.FullPath,
+		utils.FinalPath(info.FullPath),
+		filepath.Join(config.TempDirectory, downloader.downloaderId.String()),
+	} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Fatalf("%s kept after cancel: %v", leftover, err)
+		}
+	}
+}
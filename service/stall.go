@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/configs"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// serverReader reads the response of a thread and measures the time spent
+// waiting for the server, the time waited for the bandwidth limits or the
+// disk is not counted. The request is cancelled once the server sent nothing
+// for the read timeout.
+type serverReader struct {
+	reader  io.Reader
+	thread  *thread
+	idle    *time.Timer
+	timeout time.Duration
+}
+
+func newServerReader(reader io.Reader, thread *thread, cancel context.CancelCauseFunc) *serverReader {
+	serverReader := &serverReader{
+		reader:  reader,
+		thread:  thread,
+		timeout: time.Duration(configs.Get().ReadTimeout) * time.Millisecond,
+	}
+	if serverReader.timeout > 0 {
+		serverReader.idle = time.AfterFunc(serverReader.timeout, func() { cancel(utils.ReadTimeout) })
+		serverReader.idle.Stop()
+	}
+	return serverReader
+}
+
+func (reader *serverReader) Read(p []byte) (int, error) {
+	reader.thread.startRead()
+	if reader.idle != nil {
+		reader.idle.Reset(reader.timeout)
+	}
+	n, err := reader.reader.Read(p)
+	if reader.idle != nil {
+		reader.idle.Stop()
+	}
+	reader.thread.endRead()
+	return n, err
+}
+
+func (thread *thread) startRead() {
+	thread.mutex.Lock()
+	thread.readStart = time.Now()
+	thread.mutex.Unlock()
+}
+
+func (thread *thread) endRead() {
+	thread.mutex.Lock()
+	thread.readTime += time.Since(thread.readStart)
+	thread.readStart = time.Time{}
+	thread.mutex.Unlock()
+}
+
+// isStalled reports whether the thread received less than minSpeed bytes per
+// second over the last window of time spent waiting for the server
+func (thread *thread) isStalled(minSpeed float64, window time.Duration) bool {
+	thread.mutex.Lock()
+	defer thread.mutex.Unlock()
+	waited := thread.readTime
+	if !thread.readStart.IsZero() {
+		waited += time.Since(thread.readStart)
+	}
+	elapsed := waited - thread.checkedTime
+	if thread.exited || elapsed < window {
+		return false
+	}
+	speed := float64(thread.received-thread.checkedBytes) / elapsed.Seconds()
+	thread.checkedTime, thread.checkedBytes = waited, thread.received
+	return speed < minSpeed
+}
+
+// stall cancels the request of the thread
+func (thread *thread) stall() {
+	thread.mutex.Lock()
+	defer thread.mutex.Unlock()
+	if thread.cancel != nil {
+		thread.cancel(utils.ConnectionStalled)
+	}
+}
+
+// checkStalls closes the connections of threads slower than the stall speed,
+// each thread fails with ConnectionStalled and its range is retried
+func (downloader *downloader) checkStalls() {
+	minSpeed := configs.Get().StallSpeed
+	window := time.Duration(configs.Get().StallTime) * time.Millisecond
+	if minSpeed <= 0 || window <= 0 {
+		return
+	}
+
+	downloader.segmentMutex.Lock()
+	segments := make([]*Segment, 0, len(downloader.activeSegments))
+	for _, segment := range downloader.activeSegments {
+		segments = append(segments, segment)
+	}
+	downloader.segmentMutex.Unlock()
+
+	for _, segment := range segments {
+		segment.threadMutex.Lock()
+		for _, thread := range segment.threads {
+			if thread.isStalled(minSpeed, window) {
+				utils.PrintToTerminal("Connection stalled", segment.segmentId, thread.threadId, false)
+				thread.stall()
+			}
+		}
+		segment.threadMutex.Unlock()
+	}
+}
@@ -1,9 +1,14 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/arun-kushwaha04/DownloadHub/configs"
@@ -13,126 +18,311 @@ import (
 type thread struct {
 	threadId    uint8
 	startByte   int64
-	endByte     int64
+	endByte     int64 // lowered when an idle thread steals the end of the range
+	received    int64 // bytes of the range read from the response
+	exited      bool
 	startTime   time.Time
+	waited      time.Duration // time spent waiting to retry
 	segment     *Segment
+	mirror      *mirror
 	controlChan chan uint8
+	cancel      context.CancelCauseFunc
+	mutex       *sync.Mutex
+
+	readStart    time.Time     // start of the read waiting for the server, zero when not reading
+	readTime     time.Duration // time spent waiting for the server
+	checkedTime  time.Duration // readTime and received when the stall check last measured
+	checkedBytes int64
+}
+
+// a range is only stolen when both halves are at least this long
+const minStealSize int64 = 256 * 1024
+
+// stop sends a control signal to the thread, it never blocks
+func (thread *thread) stop() {
+	select {
+	case thread.controlChan <- controlPause:
+	default:
+	}
 }
 
-func (thread *thread) StartThread() {
-	defer thread.segment.waitGroup.Done()
+// StartThread downloads the byte range [startByte, endByte) and returns the
+// number of bytes written to the segment file starting from startByte
+func (thread *thread) StartThread() int64 {
+	defer thread.exit()
 
 	thread.startTime = time.Now()
 	// utils.PrintToTerminal("Starting goroutine", thread.segment.segmentId, thread.threadId, false)
 
-	url := thread.segment.downloader.GetDownloadUrl()
+	url := thread.mirror.url
 
-	req, err := http.NewRequest("GET", url.String(), nil)
-	if err != nil {
-		utils.PrintToTerminal("Unable to Create request", thread.segment.segmentId, thread.threadId, true)
-		thread.segment.errorChan <- err
-		return
-	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	thread.mutex.Lock()
+	thread.cancel = cancel
+	thread.mutex.Unlock()
 
-	req.Header.Add("Host", url.Hostname())
-	req.Header.Add("User-Agent", configs.DEFAULT_USER_AGENT)
-	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", thread.startByte, thread.endByte))
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-thread.controlChan:
+			utils.PrintToTerminal("Exiting goroutine control signal", thread.segment.segmentId, thread.threadId, false)
+			close(stopped)
+			cancel(nil)
+		case <-done:
+		}
+	}()
 
-	res, err := thread.segment.downloader.client.Do(req)
-	if err != nil {
-		utils.PrintToTerminal("Unable to make request", thread.segment.segmentId, thread.threadId, false)
-		thread.segment.errorChan <- err
-		return
+	// the request ends with the thread unless its response is handed over to
+	// the single stream, which then continues a held response
+	singleStream := thread.segment.downloader.isSingleStream()
+	res, cancelRequest := thread.segment.downloader.takeStream(thread.startByte)
+	requestCtx, cancelNew := context.WithCancelCause(context.Background())
+	if res == nil {
+		cancelRequest = cancelNew
+	} else {
+		cancelNew(nil)
 	}
-	defer res.Body.Close()
+	release := context.AfterFunc(ctx, func() { cancelRequest(context.Cause(ctx)) })
 
-	// go func() {
-	// 	// code stuck here until channel closes
-	// 	for i := range thread.controlChan {
-	// 		if i == 1 {
-	// 			utils.PrintToTerminal("Exiting goroutine control signal", thread.segment.segmentId, thread.threadId, false)
-	// 			if currentReq != nil && currentReq.Body != nil {
-	// 				currentReq.Body.Close()
-	// 			}
-	// 			thread.segment.waitGroup.Done()
-	// 		}
-	// 	}
-	// }()
+	if res == nil {
+		req, err := http.NewRequestWithContext(requestCtx, "GET", url.String(), nil)
+		if err != nil {
+			utils.PrintToTerminal("Unable to Create request", thread.segment.segmentId, thread.threadId, true)
+			thread.segment.errorChan <- thread.newError(err)
+			return 0
+		}
+
+		req.Header.Add("Host", url.Hostname())
+		req.Header.Add("User-Agent", configs.Get().UserAgent)
+		for key, value := range thread.segment.downloader.headersFor(url) {
+			req.Header.Set(key, value)
+		}
+		if !singleStream {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", thread.startByte, thread.getEndByte()-1))
+		}
+
+		res, err = thread.segment.downloader.client.Do(req)
+		if err != nil {
+			if isStopped(stopped) {
+				return 0
+			}
+			utils.PrintToTerminal("Unable to make request", thread.segment.segmentId, thread.threadId, false)
+			thread.retry(err, thread.startByte, stopped)
+			return 0
+		}
+	}
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			res.Body.Close()
+		}
+	}()
 
-	// if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+	if res.StatusCode == http.StatusOK && !singleStream {
+		// the server ignored the range and sent the whole file
+		if thread.segment.downloader.mirrors.drop(thread.mirror, utils.InvalidRangeRequested) {
+			return 0
+		}
+		// the whole file sent for a range starting at 0 is read by the single stream
+		if thread.startByte == 0 && res.ContentLength == thread.segment.downloader.resourceInfo.FileSize && release() {
+			thread.segment.downloader.holdStream(res, cancelRequest)
+			handedOver = true
+		}
+		thread.segment.downloader.switchToSingleStream()
+		return 0
+	}
 
-	// }
+	if (res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable) && thread.segment.downloader.tuner.throttle() {
+		// the range is requested again once the segment runs fewer threads
+		utils.PrintToTerminal(fmt.Sprintf("Throttled with %d", res.StatusCode), thread.segment.segmentId, thread.threadId, false)
+		thread.wait(max(throttleDelay, parseRetryAfter(res.Header.Get("Retry-After"))), stopped)
+		return 0
+	}
 
 	if res.StatusCode != http.StatusPartialContent && res.StatusCode != http.StatusOK {
 		utils.PrintToTerminal(fmt.Sprintf("Invalid response %d", res.StatusCode), thread.segment.segmentId, thread.threadId, false)
-		thread.segment.errorChan <- err
+		thread.retry(newStatusError(res), thread.startByte, stopped)
+		return 0
 	}
 
-	fileBuffer := make([]byte, 1024*1024)
+	// a server sending nothing for the read timeout cancels the request
+	serverBody := newServerReader(res.Body, thread, cancel)
+
+	if singleStream && thread.startByte > 0 {
+		// the response starts at the beginning of the file, the bytes
+		// written before the connection dropped are skipped
+		if _, err := io.CopyN(io.Discard, serverBody, thread.startByte); err != nil {
+			if !isStopped(stopped) {
+				thread.retry(readError(ctx, err), thread.startByte, stopped)
+			}
+			return 0
+		}
+	}
+
+	// every byte is taken from the download, global and host limits
+	body := newLimitedReader(serverBody, thread.segment.downloader.getRateLimiters(url.Hostname()), stopped)
+
+	fileBuffer := make([]byte, configs.Get().FileBuffSize)
 	fileBufferIdx := 0
-	var offset int64 = thread.startByte - (int64(thread.segment.segmentId) * configs.SEGMENT_SIZE)
+	var offset int64 = thread.startByte - thread.segment.segmentStart
 
 	// utils.PrintToTerminal(fmt.Sprintf("Requested byte range %d-%d, %d", thread.startByte, thread.endByte, offset), thread.segment.segmentId, thread.threadId, false)
 
 	for {
 		// read res body in buffer[idx:len(buff)]
-		n, err := res.Body.Read(fileBuffer[fileBufferIdx:])
+		n, err := body.Read(fileBuffer[fileBufferIdx:])
+
+		if n > 0 {
+			// never write past the requested range
+			n = thread.receive(n)
+			fileBufferIdx += n
+			thread.segment.downloader.bytesDownloaded.Add(int64(n))
+		}
 
-		if err == io.EOF {
+		if err == io.EOF || thread.isDone() {
 			// end of response body writing remaining bytes to files
 			if fileBufferIdx > 0 {
 				// write to file from buff[0:idx-1]
-				thread.writeToFile(&fileBuffer, &fileBufferIdx, &offset)
+				if err := thread.writeToFile(&fileBuffer, &fileBufferIdx, &offset); err != nil {
+					return thread.written(offset)
+				}
+			}
+			if err == io.EOF && thread.segment.downloader.streaming {
+				thread.segment.setSegmentEnd(thread.segment.segmentStart + offset)
 			}
 			break
 		}
 		if err != nil {
-			thread.segment.updateChunk(thread.startByte, thread.startByte+offset)
+			// bytes already received are valid, keep them before exiting
+			if fileBufferIdx > 0 {
+				if err := thread.writeToFile(&fileBuffer, &fileBufferIdx, &offset); err != nil {
+					return thread.written(offset)
+				}
+			}
+			if isStopped(stopped) {
+				return thread.written(offset)
+			}
 			utils.PrintToTerminal("Error while reading response body", thread.segment.segmentId, thread.threadId, true)
-			thread.segment.errorChan <- err
-			return
+			thread.retry(readError(ctx, err), thread.segment.segmentStart+offset, stopped)
+			return thread.written(offset)
 		}
 
 		//deciding whether to write to file
-		if fileBufferIdx == configs.FILE_BUFF_SIZE {
+		if fileBufferIdx == configs.Get().FileBuffSize {
 			// write to file from buff[0:idx-1]
-			thread.writeToFile(&fileBuffer, &fileBufferIdx, &offset)
-
-			// pausing download so that synchronized bandwidth is maintained
-			if thread.segment.downloader.instantDownloadSpeed > 0 {
-				sleepTime := time.Duration(n) * time.Second / time.Duration(thread.segment.downloader.instantDownloadSpeed)
-				if sleepTime > 0 {
-					utils.PrintToTerminal(fmt.Sprintf("Go routine sleeping for %s", sleepTime), thread.segment.segmentId, thread.threadId, false)
-					time.Sleep(sleepTime)
-				}
+			if err := thread.writeToFile(&fileBuffer, &fileBufferIdx, &offset); err != nil {
+				return thread.written(offset)
 			}
 		}
-
-		if n > 0 {
-			fileBufferIdx += n
-			thread.segment.downloader.bytesUpdateChannel <- [2]int{0, n}
-		}
 	}
 
 	// utils.PrintToTerminal("Exiting goroutine", thread.segment.segmentId, thread.threadId, false)
-	return
+	return thread.written(offset)
+}
+
+// receive accepts n bytes read from the response, fewer when the range ends before them
+func (thread *thread) receive(n int) int {
+	thread.mutex.Lock()
+	defer thread.mutex.Unlock()
+	n = int(min(int64(n), thread.endByte-thread.startByte-thread.received))
+	thread.received += int64(n)
+	return n
+}
+
+func (thread *thread) isDone() bool {
+	thread.mutex.Lock()
+	defer thread.mutex.Unlock()
+	return thread.startByte+thread.received >= thread.endByte
+}
+
+// exit keeps the range from being split once the thread stopped reading,
+// the segment gives back whatever was not downloaded
+func (thread *thread) exit() {
+	thread.mutex.Lock()
+	thread.exited = true
+	thread.mutex.Unlock()
 }
 
-func (thread *thread) writeToFile(fileBuffer *[]byte, fileBufferIdx *int, offset *int64) {
+func (thread *thread) getEndByte() int64 {
+	thread.mutex.Lock()
+	defer thread.mutex.Unlock()
+	return thread.endByte
+}
+
+// remainingTime estimates the seconds the thread needs to finish its range,
+// a thread which received nothing yet is treated as the slowest
+func (thread *thread) remainingTime() float64 {
+	thread.mutex.Lock()
+	defer thread.mutex.Unlock()
+	remaining := thread.endByte - thread.startByte - thread.received
+	if thread.received == 0 {
+		return math.MaxFloat64
+	}
+	speed := float64(thread.received) / time.Since(thread.startTime).Seconds()
+	return float64(remaining) / speed
+}
+
+// split cuts the rest of the range in half and returns the second half for
+// an idle thread, the thread stops once it reaches the new end
+func (thread *thread) split() ([2]int64, bool) {
+	thread.mutex.Lock()
+	defer thread.mutex.Unlock()
+	position := thread.startByte + thread.received
+	remaining := thread.endByte - position
+	if thread.exited || remaining < 2*minStealSize {
+		return [2]int64{}, false
+	}
+	stolen := [2]int64{position + remaining/2, thread.endByte}
+	thread.endByte = stolen[0]
+	return stolen, true
+}
+
+// written converts the segment file offset to bytes written by the thread
+func (thread *thread) written(offset int64) int64 {
+	return offset - (thread.startByte - thread.segment.segmentStart)
+}
+
+func (thread *thread) writeToFile(fileBuffer *[]byte, fileBufferIdx *int, offset *int64) error {
 
 	startTime := time.Now()
-	wt, err := thread.segment.file.WriteAt((*fileBuffer)[:*fileBufferIdx], *offset)
+	wt, err := thread.segment.file.WriteAt((*fileBuffer)[:*fileBufferIdx], thread.segment.fileOffset+*offset)
 
 	if err != nil {
-		thread.segment.updateChunk(thread.startByte, thread.startByte+*offset)
+		*offset += int64(wt)
 		utils.PrintToTerminal("Unable to write to segment file", thread.segment.segmentId, thread.threadId, true)
-		thread.segment.errorChan <- err
-		return
+		kind := utils.FileWritePermissionError
+		if errors.Is(err, syscall.ENOSPC) {
+			kind = utils.NoEnoughSpace
+		}
+		thread.segment.errorChan <- thread.newError(utils.NewError(kind, err))
+		return err
 	}
-	thread.segment.downloader.writeTimeChannel <- time.Since(startTime)
-	thread.segment.downloader.bytesUpdateChannel <- [2]int{1, wt}
+	thread.segment.downloader.writeTime.Add(int64(time.Since(startTime)))
+	thread.segment.downloader.bytesWrittenToDisk.Add(int64(wt))
+	thread.segment.downloader.journal.record([2]int64{thread.segment.segmentStart + *offset, thread.segment.segmentStart + *offset + int64(wt)})
 	*offset += int64(wt)
 	*fileBufferIdx = 0
 
-	return
+	return nil
+}
+
+// readError replaces the error of a read cancelled by the read timeout or
+// the stall check with the reason of the cancel
+func readError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil && cause != context.Canceled {
+		return cause
+	}
+	return err
+}
+
+func isStopped(stopped chan struct{}) bool {
+	select {
+	case <-stopped:
+		return true
+	default:
+		return false
+	}
 }
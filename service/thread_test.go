@@ -0,0 +1,60 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRangeIgnoredAtStart(t *testing.T) {
+	config := setTestConfig(t)
+	config.SegmentSize = 4 * 1024 * 1024
+	data := randomData(t, 3*1024*1024)
+
+	// the server claims range support but sends the whole file to every GET
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		requests.Add(1)
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient()
+	t.Cleanup(client.Close)
+	download, err := client.NewDownload(server.URL+"/file.bin", WithThreads(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := download.Info()
+	got, err := os.ReadFile(info.FullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs")
+	}
+	// the response to the first range is read as the single stream
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("file requested %d times, want once", n)
+	}
+}
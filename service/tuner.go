@@ -0,0 +1,125 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// threads a segment may run when the download sets no MaxThreadCount
+const maxSegmentThreads = 8
+
+// a thread is kept when it raised the throughput by at least this ratio
+const tunerGain = 1.1
+
+// stats intervals the throughput is measured over before the thread count changes
+const tunerSamples = 3
+
+// measurements waited after a thread did not help or the server throttled
+const tunerHold = 5
+
+// throttled threads wait this long before their range is requested again,
+// further 429 or 503 answers within it do not lower the thread count again
+const throttleDelay = 2 * time.Second
+
+// threadTuner adapts the number of threads every segment runs. A thread is
+// added while the throughput of the download keeps rising, a thread which
+// did not help is taken away again and the count is halved when the server
+// answers with 429 or 503. The count never goes above the ceiling.
+type threadTuner struct {
+	threads int
+	ceiling int
+
+	bytes     int64
+	elapsed   time.Duration
+	samples   int
+	lastSpeed float64 // throughput measured before the last added thread
+	probing   bool    // a thread was added and its effect is being measured
+	hold      int
+
+	lastThrottle time.Time
+	mutex        *sync.Mutex
+}
+
+func newThreadTuner(ceiling uint8) *threadTuner {
+	if ceiling == 0 {
+		ceiling = maxSegmentThreads
+	}
+	return &threadTuner{
+		threads: min(int(defaultSegmentThreads), int(ceiling)),
+		ceiling: int(ceiling),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (tuner *threadTuner) getThreads() int {
+	tuner.mutex.Lock()
+	defer tuner.mutex.Unlock()
+	return tuner.threads
+}
+
+// sample adds the bytes downloaded in one stats interval, it returns true
+// when the thread count changed
+func (tuner *threadTuner) sample(bytes int, interval time.Duration) bool {
+	tuner.mutex.Lock()
+	defer tuner.mutex.Unlock()
+
+	if bytes == 0 {
+		// nothing is downloading, the measurement would be meaningless
+		tuner.bytes, tuner.elapsed, tuner.samples = 0, 0, 0
+		return false
+	}
+	tuner.bytes += int64(bytes)
+	tuner.elapsed += interval
+	tuner.samples++
+	if tuner.samples < tunerSamples {
+		return false
+	}
+	speed := float64(tuner.bytes) / tuner.elapsed.Seconds()
+	tuner.bytes, tuner.elapsed, tuner.samples = 0, 0, 0
+
+	threads := tuner.threads
+	switch {
+	case tuner.probing && speed < tuner.lastSpeed*tunerGain:
+		// the added thread did not help
+		tuner.threads--
+		tuner.probing = false
+		tuner.hold = tunerHold
+	case tuner.hold > 0:
+		tuner.hold--
+	case tuner.threads < tuner.ceiling:
+		tuner.threads++
+		tuner.probing = true
+	default:
+		tuner.probing = false
+	}
+	tuner.lastSpeed = speed
+	if tuner.threads != threads {
+		fmt.Println("Threads per segment", threads, "->", tuner.threads, fmt.Sprintf("at %.0f B/s", speed))
+		return true
+	}
+	return false
+}
+
+// throttle halves the thread count after the server answered with 429 or
+// 503, it returns false when a single thread is already throttled and the
+// download can not back off any further
+func (tuner *threadTuner) throttle() bool {
+	tuner.mutex.Lock()
+	defer tuner.mutex.Unlock()
+
+	if time.Since(tuner.lastThrottle) < throttleDelay {
+		// threads running before the last throttle are still answered
+		return true
+	}
+	if tuner.threads == 1 {
+		return false
+	}
+	tuner.lastThrottle = time.Now()
+	tuner.threads = max(tuner.threads/2, 1)
+	tuner.probing = false
+	tuner.hold = tunerHold
+	tuner.bytes, tuner.elapsed, tuner.samples = 0, 0, 0
+	fmt.Println("Server is throttling, threads per segment lowered to", tuner.threads)
+	return true
+}
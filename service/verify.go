@@ -0,0 +1,242 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+// startVerify marks a finished download as being verified
+func (downloader *downloader) startVerify() error {
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+
+	switch downloader.GetStatus() {
+	case pkg.Completed, pkg.ChecksumMismatch:
+	default:
+		return utils.DownloadNotFinished
+	}
+	downloader.setStatus(pkg.Verifying)
+	return nil
+}
+
+// Verify checks every segment of the downloaded file against the piece hashes
+// of the download, a sidecar piece list or the server. It returns true when
+// corrupt segments were found, the download is then prepared to download
+// only those segments again.
+func (downloader *downloader) Verify() bool {
+	fmt.Println("Verifying download", downloader.downloaderId)
+
+	corrupt, err := downloader.findCorruptSegments()
+	if err != nil {
+		fmt.Println("Unable to verify download", err)
+		downloader.fail(pkg.Failed, err)
+		return false
+	}
+	if len(corrupt) > 0 {
+		fmt.Println("Corrupt segments", corrupt, "are downloaded again")
+		if err := downloader.prepareRepair(corrupt); err != nil {
+			downloader.fail(pkg.Failed, err)
+			return false
+		}
+		return true
+	}
+
+	if err := downloader.verifyFileChecksum(); errors.Is(err, utils.ChecksumMismatch) {
+		downloader.fail(pkg.ChecksumMismatch, err)
+		return false
+	} else if err != nil {
+		downloader.fail(pkg.Failed, err)
+		return false
+	}
+	downloader.fail(pkg.Completed, nil)
+	return false
+}
+
+// findCorruptSegments returns the segments of the file not matching their
+// pieces, without pieces every segment is compared with the server
+func (downloader *downloader) findCorruptSegments() ([]int64, error) {
+	file, err := os.Open(downloader.fullPath)
+	if err != nil {
+		return nil, utils.NewError(utils.MissingMainFile, err)
+	}
+	defer file.Close()
+
+	pieces := downloader.pieces
+	if pieces == nil && downloader.resourceInfo.Resumeable {
+		pieces = utils.FindPieces(downloader.ctx, downloader.resourceInfo.Url, downloader.resourceInfo.FileSize, downloader.downloadPrt.GetHeaders())
+	}
+
+	var corrupt []int64
+	fileSize := downloader.resourceInfo.FileSize
+	switch {
+	case pieces != nil:
+		hasher := utils.NewHash(pieces.Algorithm)
+		for piece, expected := range pieces.Hashes {
+			start := int64(piece) * pieces.Length
+			end := min(start+pieces.Length, fileSize)
+			hasher.Reset()
+			if _, err := io.Copy(hasher, io.NewSectionReader(file, start, end-start)); err != nil {
+				return nil, utils.NewError(utils.FileReadPermissionError, err)
+			}
+			if bytes.Equal(hasher.Sum(nil), expected) {
+				continue
+			}
+			// a piece may cross the border of two segments
+			for segmentId := start / downloader.segmentSize; segmentId*downloader.segmentSize < end; segmentId++ {
+				if !slices.Contains(corrupt, segmentId) {
+					corrupt = append(corrupt, segmentId)
+				}
+			}
+		}
+	case downloader.resourceInfo.Resumeable:
+		for segmentId := range downloader.totalSegments {
+			matches, err := downloader.recheckSegment(file, segmentId)
+			if err != nil {
+				return nil, err
+			}
+			if !matches {
+				corrupt = append(corrupt, segmentId)
+			}
+		}
+	}
+	return corrupt, nil
+}
+
+// recheckSegment downloads the range of a segment again and compares it with the file
+func (downloader *downloader) recheckSegment(file *os.File, segmentId int64) (bool, error) {
+	start := segmentId * downloader.segmentSize
+	end := min(start+downloader.segmentSize, downloader.resourceInfo.FileSize)
+
+	headers := map[string]string{}
+	for key, value := range downloader.headersFor(downloader.GetDownloadUrl()) {
+		headers[key] = value
+	}
+	headers["Range"] = fmt.Sprintf("bytes=%d-%d", start, end-1)
+	req, err := utils.NewRequest(downloader.ctx, "GET", downloader.GetDownloadUrl(), nil, &headers)
+	if err != nil {
+		return false, err
+	}
+	res, err := downloader.client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return false, utils.NewError(utils.HttpRequestError, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return false, utils.NewError(utils.ServerError, nil).WithStatus(res.StatusCode, 0)
+	}
+
+	remote := sha256.New()
+	if _, err := io.Copy(remote, io.LimitReader(res.Body, end-start)); err != nil {
+		return false, utils.NewError(utils.HttpRequestError, err)
+	}
+	local := sha256.New()
+	if _, err := io.Copy(local, io.NewSectionReader(file, start, end-start)); err != nil {
+		return false, utils.NewError(utils.FileReadPermissionError, err)
+	}
+	return bytes.Equal(remote.Sum(nil), local.Sum(nil)), nil
+}
+
+// prepareRepair resets the download so StartDownload downloads only the
+// corrupt segments and writes them into the file
+func (downloader *downloader) prepareRepair(corrupt []int64) error {
+	downloader.segmentMutex.Lock()
+	downloader.repairSegments = make(map[int64]bool)
+	downloader.finishedSegments = make(map[int64]bool)
+	downloader.segmentProgress = make(map[int64][][2]int64)
+	downloader.completedSegments = 0
+	var chunks [][2]int64
+	for segmentId := range downloader.totalSegments {
+		if slices.Contains(corrupt, segmentId) {
+			downloader.repairSegments[segmentId] = true
+			continue
+		}
+		downloader.finishedSegments[segmentId] = true
+		downloader.completedSegments++
+		end := min((segmentId+1)*downloader.segmentSize, downloader.resourceInfo.FileSize)
+		chunks = mergeChunk(chunks, [2]int64{segmentId * downloader.segmentSize, end})
+	}
+	header := downloader.getJournalHeader()
+	downloader.segmentMutex.Unlock()
+
+	// the error channel is closed when StartDownload returns
+	downloader.errorChan = make(chan error)
+	downloader.bytesDownloaded.Store(0)
+	downloader.bytesWrittenToDisk.Store(0)
+	downloader.writeTime.Store(0)
+	downloader.monitoredBytes = 0
+	if state := downloader.checksum.Load(); state != nil {
+		downloader.checksum.Store(newChecksumState(state.expected))
+	}
+
+	if err := downloader.journal.reset(header); err != nil {
+		return err
+	}
+	// the journal holds the good segments so a restart does not download them
+	for _, chunk := range chunks {
+		downloader.journal.record(chunk)
+	}
+	if err := downloader.journal.flush(func() {}); err != nil {
+		return err
+	}
+
+	// waiters of the repair are woken up once it ended
+	downloader.statusMutex.Lock()
+	downloader.done = make(chan struct{})
+	downloader.status = pkg.Queued
+	downloader.statusMutex.Unlock()
+	return nil
+}
+
+func (downloader *downloader) isRepairing() bool {
+	downloader.segmentMutex.Lock()
+	defer downloader.segmentMutex.Unlock()
+	return downloader.repairSegments != nil
+}
+
+func (downloader *downloader) endRepair() {
+	downloader.segmentMutex.Lock()
+	downloader.repairSegments = nil
+	downloader.segmentMutex.Unlock()
+}
+
+// verifyFileChecksum hashes the merged file again and compares it with the expected digest
+func (downloader *downloader) verifyFileChecksum() error {
+	if downloader.checksum.Load() == nil {
+		return nil
+	}
+	if err := downloader.hashFile(); err != nil {
+		return err
+	}
+	return downloader.compareChecksum()
+}
+
+// hashFile hashes the merged file, used when only some segments were downloaded
+func (downloader *downloader) hashFile() error {
+	state := downloader.checksum.Load()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	file, err := os.Open(downloader.fullPath)
+	if err != nil {
+		return utils.NewError(utils.MissingMainFile, err)
+	}
+	defer file.Close()
+
+	state.hasher.Reset()
+	n, err := io.Copy(state.hasher, file)
+	state.hashedOffset = n
+	if err != nil {
+		return utils.NewError(utils.FileReadPermissionError, err)
+	}
+	return nil
+}
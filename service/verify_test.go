@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/utils"
+)
+
+func TestCancelRepairKeepsFile(t *testing.T) {
+	config := setTestConfig(t)
+	data := randomData(t, 2*1024*1024)
+
+	// once hold is set requests wait until they are cancelled
+	var hold atomic.Bool
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hold.Load() {
+			select {
+			case requested <- struct{}{}:
+			default:
+			}
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient()
+	t.Cleanup(client.Close)
+	download, err := client.NewDownload(server.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := download.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	downloader := download.downloader
+	fullPath := downloader.getFullPath()
+
+	// corrupt the first segment and repair it the way the manager does
+	corrupted := slices.Clone(data)
+	corrupted[0] ^= 0xff
+	if err := os.WriteFile(fullPath, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloader.startVerify(); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := downloader.findCorruptSegments()
+	if err != nil || !slices.Equal(corrupt, []int64{0}) {
+		t.Fatalf("corrupt segments %v: %v", corrupt, err)
+	}
+	hold.Store(true)
+	if err := downloader.prepareRepair(corrupt); err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- download.Wait() }()
+	client.manager.mutex.Lock()
+	client.manager.enqueue(downloader, false)
+	client.manager.schedule()
+	client.manager.mutex.Unlock()
+
+	<-requested
+	select {
+	case err := <-waited:
+		t.Fatalf("wait returned %v while the repair was running", err)
+	default:
+	}
+	if err := download.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waited; !errors.Is(err, utils.DownloadCancelled) {
+		t.Fatalf("wait returned %v, want DownloadCancelled", err)
+	}
+
+	got, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatalf("cancelled repair removed the file: %v", err)
+	}
+	if !bytes.Equal(got, corrupted) {
+		t.Fatal("cancelled repair changed the file")
+	}
+	if _, err := os.Stat(filepath.Join(config.TempDirectory, downloader.downloaderId.String())); !os.IsNotExist(err) {
+		t.Fatalf("temporary files of the repair kept: %v", err)
+	}
+}
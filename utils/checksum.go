@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	pkg "github.com/arun-kushwaha04/DownloadHub/pkg"
+)
+
+// checksum files looked up next to a download, strongest algorithm first
+var checksumSidecars = []struct {
+	algorithm string
+	extension string
+	sumsFile  string
+}{
+	{"sha512", ".sha512", "SHA512SUMS"},
+	{"sha256", ".sha256", "SHA256SUMS"},
+	{"sha1", ".sha1", "SHA1SUMS"},
+	{"md5", ".md5", "MD5SUMS"},
+}
+
+// digest algorithm names used in Digest and Repr-Digest headers
+var digestAlgorithms = map[string]string{
+	"sha-512": "sha512",
+	"sha-256": "sha256",
+	"sha":     "sha1",
+	"md5":     "md5",
+}
+
+func NewHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// ParseDigestHeader reads the strongest digest from a RFC 3230 Digest header
+// or a RFC 9530 Repr-Digest header
+func ParseDigestHeader(header http.Header) *pkg.Checksum {
+	var best *pkg.Checksum
+	values := append(header.Values("Repr-Digest"), header.Values("Digest")...)
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			name, encoded, found := strings.Cut(strings.TrimSpace(entry), "=")
+			if !found {
+				continue
+			}
+			algorithm, ok := digestAlgorithms[strings.ToLower(name)]
+			if !ok {
+				continue
+			}
+			// Repr-Digest wraps the value in colons
+			digest, err := base64.StdEncoding.DecodeString(strings.Trim(encoded, ":"))
+			if err != nil || len(digest) != pkg.ChecksumSizes[algorithm] {
+				continue
+			}
+			if best == nil || len(digest) > len(best.Value) {
+				best = &pkg.Checksum{Algorithm: algorithm, Value: digest}
+			}
+		}
+	}
+	return best
+}
+
+// FindChecksum looks for a published checksum of the resource in sidecar
+// files such as file.iso.sha256 or a SHA256SUMS file in the same directory
+func FindChecksum(ctx context.Context, resourceUrl *url.URL, fileName string, headers map[string]string) *pkg.Checksum {
+	for _, sidecar := range checksumSidecars {
+		sidecarUrl := *resourceUrl
+		sidecarUrl.Path += sidecar.extension
+		sidecarUrl.RawPath = ""
+		if checksum := findChecksumInFile(ctx, &sidecarUrl, sidecar.algorithm, "", headers); checksum != nil {
+			return checksum
+		}
+
+		sumsUrl := *resourceUrl
+		sumsUrl.Path = path.Join(path.Dir(resourceUrl.Path), sidecar.sumsFile)
+		sumsUrl.RawPath = ""
+		sumsUrl.RawQuery = ""
+		if checksum := findChecksumInFile(ctx, &sumsUrl, sidecar.algorithm, fileName, headers); checksum != nil {
+			return checksum
+		}
+	}
+	return nil
+}
+
+// findChecksumInFile reads a checksum file made of "<hex digest> [*]<file name>"
+// lines, an empty fileName accepts the first digest found
+func findChecksumInFile(ctx context.Context, fileUrl *url.URL, algorithm string, fileName string, headers map[string]string) *pkg.Checksum {
+	client, req, err := GetClient(ctx, "GET", fileUrl, nil, &headers)
+	if err != nil {
+		return nil
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(res.Body, 1024*1024))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fileName != "" && (len(fields) < 2 || strings.TrimPrefix(fields[1], "*") != fileName) {
+			continue
+		}
+		digest, err := hex.DecodeString(fields[0])
+		if err != nil || len(digest) != pkg.ChecksumSizes[algorithm] {
+			continue
+		}
+		return &pkg.Checksum{Algorithm: algorithm, Value: digest}
+	}
+	return nil
+}
@@ -2,26 +2,136 @@ package utils
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arun-kushwaha04/DownloadHub/pkg"
+	"github.com/google/uuid"
 )
 
-type ThreadError struct {
-	threadId uint8
-	err      error
+// DownloadError is an error located in a download. Kind is one of the
+// errors below and Cause the error which actually happened, errors.Is and
+// errors.As match both of them. Segment and Thread are -1 and Range is empty
+// when the error is not about a byte range.
+type DownloadError struct {
+	Kind       error
+	DownloadId uuid.UUID
+	Segment    int64
+	Thread     int
+	Range      [2]int64 // [start, end)
+	StatusCode int      // status the server answered with, 0 without a response
+	RetryAfter time.Duration
+	Cause      error
+}
+
+func NewError(kind error, cause error) *DownloadError {
+	return &DownloadError{Kind: kind, Segment: -1, Thread: -1, Cause: cause}
+}
+
+func (err *DownloadError) InDownload(downloadId uuid.UUID) *DownloadError {
+	err.DownloadId = downloadId
+	return err
+}
+
+func (err *DownloadError) InSegment(segment int64, byteRange [2]int64) *DownloadError {
+	err.Segment = segment
+	err.Range = byteRange
+	return err
+}
+
+func (err *DownloadError) InThread(segment int64, thread uint8, byteRange [2]int64) *DownloadError {
+	err.Thread = int(thread)
+	return err.InSegment(segment, byteRange)
 }
 
-func NewThreadError(threadId uint8, err error) ThreadError {
-	return ThreadError{
-		threadId: threadId,
-		err:      err,
+func (err *DownloadError) WithStatus(statusCode int, retryAfter time.Duration) *DownloadError {
+	err.StatusCode = statusCode
+	err.RetryAfter = retryAfter
+	return err
+}
+
+func (err *DownloadError) Error() string {
+	var details []string
+	if err.DownloadId != uuid.Nil {
+		details = append(details, "download "+err.DownloadId.String())
+	}
+	if err.Segment >= 0 {
+		details = append(details, fmt.Sprintf("segment %d", err.Segment))
 	}
+	if err.Thread >= 0 {
+		details = append(details, fmt.Sprintf("thread %d", err.Thread))
+	}
+	if err.Range[1] > err.Range[0] {
+		details = append(details, fmt.Sprintf("bytes %d-%d", err.Range[0], err.Range[1]-1))
+	}
+	if err.StatusCode != 0 {
+		details = append(details, fmt.Sprintf("status %d %s", err.StatusCode, http.StatusText(err.StatusCode)))
+	}
+
+	message := "Download error"
+	if err.Kind != nil {
+		message = err.Kind.Error()
+	}
+	if len(details) > 0 {
+		message += " (" + strings.Join(details, ", ") + ")"
+	}
+	if err.Cause != nil {
+		message += ": " + err.Cause.Error()
+	}
+	return message
 }
 
-func (te ThreadError) Error() string {
-	return te.err.Error()
+func (err *DownloadError) Unwrap() []error {
+	var errs []error
+	for _, e := range []error{err.Kind, err.Cause} {
+		if e != nil {
+			errs = append(errs, e)
+		}
+	}
+	return errs
 }
 
-func (te ThreadError) GetThreadId() uint8 {
-	return te.threadId
+// ErrorDetails flattens the download errors wrapped in err for api clients,
+// a field is taken from the outermost error knowing it and the kind from the
+// innermost one, it is nil when err is no download error
+func ErrorDetails(err error) *pkg.ErrorDetails {
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		return nil
+	}
+	details := &pkg.ErrorDetails{Kind: err.Error()}
+	for err != nil {
+		downloadErr, ok := err.(*DownloadError)
+		if !ok {
+			if details.Cause == "" {
+				details.Cause = err.Error()
+			}
+			err = errors.Unwrap(err)
+			continue
+		}
+		if downloadErr.Kind != nil {
+			details.Kind = downloadErr.Kind.Error()
+		}
+		if downloadErr.Segment >= 0 && details.Segment == nil {
+			details.Segment = &downloadErr.Segment
+		}
+		if downloadErr.Thread >= 0 && details.Thread == nil {
+			details.Thread = &downloadErr.Thread
+		}
+		if downloadErr.Range[1] > downloadErr.Range[0] && details.Range == nil {
+			details.Range = &downloadErr.Range
+		}
+		if details.StatusCode == 0 {
+			details.StatusCode = downloadErr.StatusCode
+		}
+		err = downloadErr.Cause
+	}
+	if details.Cause == details.Kind {
+		details.Cause = ""
+	}
+	return details
 }
 
 var HttpClientIntalizationError = errors.New("Unable to create http client")
@@ -38,6 +148,7 @@ var FileWritePermissionError = errors.New("No permission to write to file")
 var NoEnoughSpace = errors.New("Not enough space")
 var FileNotFound = errors.New("File not found")
 var FileRenameError = errors.New("No permission to rename file")
+var FileAlreadyExists = errors.New("File already exists")
 var TempDirCreatePermissionError = errors.New("No permission to create temporary directory")
 var DownloadDirCreatePermissinError = errors.New("No permission to create download directory")
 var DownloadFailed = errors.New("Download failed")
@@ -46,3 +157,19 @@ var MissingMainFile = errors.New("Main download file not found")
 var DownloadFailedDueToMissingFiles = errors.New("Segment file are missing")
 var FileRebiuldError = errors.New("File rebuilding failed")
 var DownloadFailedRenameError = errors.New("Download completed unable to rename file")
+var DownloadNotRunning = errors.New("Download is not running")
+var DownloadNotPaused = errors.New("Download is not paused")
+var DownloadAlreadyFinished = errors.New("Download already finished")
+var InvalidJournal = errors.New("Download journal is corrupted")
+var DownloadNotFound = errors.New("Download not found")
+var ChecksumMismatch = errors.New("Downloaded file does not match the expected checksum")
+var InvalidMetalink = errors.New("Invalid metalink document")
+var MetalinkUnavailable = errors.New("No url of the metalink serves the file")
+var PieceMismatch = errors.New("Downloaded piece does not match its hash")
+var DownloadNotFinished = errors.New("Download is not finished")
+var DownloadBusy = errors.New("Download is being merged or verified")
+var ReadTimeout = errors.New("Server sent no data before the read timeout")
+var ConnectionStalled = errors.New("Connection is slower than the stall speed")
+var DownloadAlreadyStarted = errors.New("Download already started")
+var DownloadCancelled = errors.New("Download cancelled")
+var CredentialsMissing = errors.New("Credential headers of the download were not kept after the restart")
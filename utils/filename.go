@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const defaultFileName = "download"
+
+// extensions used for common types where mime lists a rarer one first
+var preferredExtensions = map[string]string{
+	"text/plain": ".txt",
+	"text/html":  ".html",
+	"image/jpeg": ".jpg",
+}
+
+// GetFileName resolves the name a response is saved under, the name sent in
+// Content-Disposition wins over the last element of the final url. A name
+// without an extension gets one from the Content-Type.
+func GetFileName(res *http.Response) string {
+	fileName := fileNameFromDisposition(res.Header.Get("Content-Disposition"))
+	if fileName == "" {
+		fileName = SanitizeFileName(path.Base(res.Request.URL.Path))
+	}
+	if fileName == "" {
+		fileName = defaultFileName
+	}
+
+	if path.Ext(fileName) == "" {
+		fileName += extensionFromContentType(res.Header.Get("Content-Type"))
+	}
+	return fileName
+}
+
+// fileNameFromDisposition returns the filename parameter, mime decodes the
+// RFC 5987 filename* form and prefers it over the plain one
+func fileNameFromDisposition(disposition string) string {
+	if disposition == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		return ""
+	}
+	return SanitizeFileName(params["filename"])
+}
+
+// SanitizeFileName keeps the name from escaping the download folder
+func SanitizeFileName(fileName string) string {
+	fileName = strings.ReplaceAll(fileName, "\\", "/")
+	fileName = strings.TrimSpace(path.Base(fileName))
+	switch fileName {
+	case ".", "..", "/":
+		return ""
+	}
+	return fileName
+}
+
+func extensionFromContentType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return ""
+	}
+	if extension, ok := preferredExtensions[mediaType]; ok {
+		return extension
+	}
+	extensions, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+	return extensions[0]
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copySegment copies size bytes of src into dst at offset. A reflink shares
+// the blocks on btrfs and XFS, otherwise copy_file_range copies inside the
+// kernel and file systems supporting neither are copied through user space.
+func copySegment(dst *os.File, src *os.File, offset int64, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	clone := unix.FileCloneRange{
+		Src_fd:      int64(src.Fd()),
+		Src_length:  uint64(size),
+		Dest_offset: uint64(offset),
+	}
+	if err := unix.IoctlFileCloneRange(int(dst.Fd()), &clone); err == nil {
+		return nil
+	}
+
+	var copied int64
+	for copied < size {
+		srcOffset, dstOffset := copied, offset+copied
+		n, err := unix.CopyFileRange(int(src.Fd()), &srcOffset, int(dst.Fd()), &dstOffset, int(size-copied), 0)
+		if err != nil || n == 0 {
+			break
+		}
+		copied += int64(n)
+	}
+	return copyRange(dst, src, offset+copied, copied, size-copied)
+}
+
+// FreeSpace returns the bytes available to the user on the file system of dir
+func FreeSpace(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
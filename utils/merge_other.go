@@ -0,0 +1,14 @@
+//go:build !linux
+
+package utils
+
+import "os"
+
+func copySegment(dst *os.File, src *os.File, offset int64, size int64) error {
+	return copyRange(dst, src, offset, 0, size)
+}
+
+// FreeSpace is not known on this platform, -1 is returned
+func FreeSpace(dir string) (int64, error) {
+	return -1, nil
+}
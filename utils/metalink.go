@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	pkg "github.com/arun-kushwaha04/DownloadHub/pkg"
+)
+
+// lowest priority, used for urls without one
+const metalinkNoPriority = 999999
+
+// hash names of metalink 4 (RFC 5854) and metalink 3
+var metalinkAlgorithms = map[string]string{
+	"sha-512": "sha512",
+	"sha512":  "sha512",
+	"sha-256": "sha256",
+	"sha256":  "sha256",
+	"sha-1":   "sha1",
+	"sha1":    "sha1",
+	"md5":     "md5",
+}
+
+// Metalink is the file described by a metalink document
+type Metalink struct {
+	FileName string
+	FileSize int64 // UnknownFileSize when the document has no size
+	Urls     []MetalinkUrl
+	Checksum *pkg.Checksum
+	Pieces   *pkg.Pieces
+}
+
+// MetalinkUrl is a http url of the file, urls are sorted by priority
+type MetalinkUrl struct {
+	Url      string
+	Location string // ISO 3166 country code of the mirror
+	Priority int    // 1 is the most preferred
+}
+
+// metalinkDocument matches both versions, metalink 4 lists the file elements
+// directly while metalink 3 wraps them along with hashes and urls
+type metalinkDocument struct {
+	Files   []metalinkFile `xml:"file"`
+	Files30 []metalinkFile `xml:"files>file"`
+}
+
+type metalinkFile struct {
+	Name   string           `xml:"name,attr"`
+	Size   int64            `xml:"size"`
+	Hashes []metalinkHash   `xml:"hash"`
+	Pieces []metalinkPieces `xml:"pieces"`
+	Urls   []metalinkUrl    `xml:"url"`
+
+	Verification struct {
+		Hashes []metalinkHash   `xml:"hash"`
+		Pieces []metalinkPieces `xml:"pieces"`
+	} `xml:"verification"`
+	Resources struct {
+		Urls []metalinkUrl `xml:"url"`
+	} `xml:"resources"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Type   string         `xml:"type,attr"`
+	Length int64          `xml:"length,attr"`
+	Hashes []metalinkHash `xml:"hash"`
+}
+
+type metalinkUrl struct {
+	Location   string `xml:"location,attr"`
+	Priority   int    `xml:"priority,attr"`   // metalink 4, lower is preferred
+	Preference int    `xml:"preference,attr"` // metalink 3, 0 to 100 with higher preferred
+	Value      string `xml:",chardata"`
+}
+
+// IsMetalink reports whether a file name or content type names a metalink document
+func IsMetalink(fileName string, contentType string) bool {
+	switch path.Ext(fileName) {
+	case ".meta4", ".metalink":
+		return true
+	}
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "application/metalink4+xml", "application/metalink+xml":
+		return true
+	}
+	return false
+}
+
+// FetchMetalink downloads and parses a metalink document
+func FetchMetalink(ctx context.Context, resourceUrl *url.URL, headers map[string]string) (*Metalink, error) {
+	client, req, err := GetClient(ctx, "GET", resourceUrl, nil, &headers)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return nil, NewError(HttpClientIntalizationError, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, NewError(ServerError, nil).WithStatus(res.StatusCode, 0)
+	}
+	return ParseMetalink(io.LimitReader(res.Body, 16*1024*1024))
+}
+
+// ParseMetalink reads the first file of a metalink 4 or metalink 3 document
+// having a http url, other files are ignored
+func ParseMetalink(reader io.Reader) (*Metalink, error) {
+	var document metalinkDocument
+	if err := xml.NewDecoder(reader).Decode(&document); err != nil {
+		return nil, fmt.Errorf("%w: %v", InvalidMetalink, err)
+	}
+
+	for _, file := range append(document.Files, document.Files30...) {
+		metalink := file.parse()
+		if len(metalink.Urls) == 0 {
+			continue
+		}
+		if metalink.FileName == "" {
+			return nil, fmt.Errorf("%w: file has no name", InvalidMetalink)
+		}
+		return metalink, nil
+	}
+	return nil, fmt.Errorf("%w: no file with a http url", InvalidMetalink)
+}
+
+func (file metalinkFile) parse() *Metalink {
+	metalink := &Metalink{
+		FileName: SanitizeFileName(file.Name),
+		FileSize: pkg.UnknownFileSize,
+	}
+	if file.Size > 0 {
+		metalink.FileSize = file.Size
+	}
+
+	for _, hash := range append(file.Hashes, file.Verification.Hashes...) {
+		checksum := hash.parse()
+		if checksum != nil && (metalink.Checksum == nil || len(checksum.Value) > len(metalink.Checksum.Value)) {
+			metalink.Checksum = checksum
+		}
+	}
+
+	for _, pieces := range append(file.Pieces, file.Verification.Pieces...) {
+		parsed := pieces.parse()
+		if parsed != nil && (metalink.Pieces == nil || pkg.ChecksumSizes[parsed.Algorithm] > pkg.ChecksumSizes[metalink.Pieces.Algorithm]) {
+			metalink.Pieces = parsed
+		}
+	}
+
+	for _, fileUrl := range append(file.Urls, file.Resources.Urls...) {
+		parsedUrl, err := url.Parse(strings.TrimSpace(fileUrl.Value))
+		if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+			continue
+		}
+		priority := fileUrl.Priority
+		if fileUrl.Preference > 0 {
+			priority = 101 - min(fileUrl.Preference, 100)
+		}
+		if priority <= 0 {
+			priority = metalinkNoPriority
+		}
+		metalink.Urls = append(metalink.Urls, MetalinkUrl{
+			Url:      parsedUrl.String(),
+			Location: strings.ToLower(fileUrl.Location),
+			Priority: priority,
+		})
+	}
+	slices.SortStableFunc(metalink.Urls, func(a, b MetalinkUrl) int {
+		return a.Priority - b.Priority
+	})
+	return metalink
+}
+
+func (hash metalinkHash) parse() *pkg.Checksum {
+	algorithm, ok := metalinkAlgorithms[strings.ToLower(hash.Type)]
+	if !ok {
+		return nil
+	}
+	digest, err := hex.DecodeString(strings.TrimSpace(hash.Value))
+	if err != nil || len(digest) != pkg.ChecksumSizes[algorithm] {
+		return nil
+	}
+	return &pkg.Checksum{Algorithm: algorithm, Value: digest}
+}
+
+func (pieces metalinkPieces) parse() *pkg.Pieces {
+	algorithm, ok := metalinkAlgorithms[strings.ToLower(pieces.Type)]
+	if !ok || pieces.Length <= 0 || len(pieces.Hashes) == 0 {
+		return nil
+	}
+	parsed := &pkg.Pieces{Algorithm: algorithm, Length: pieces.Length}
+	for _, hash := range pieces.Hashes {
+		// piece hashes have no type of their own
+		hash.Type = pieces.Type
+		checksum := hash.parse()
+		if checksum == nil {
+			return nil
+		}
+		parsed.Hashes = append(parsed.Hashes, checksum.Value)
+	}
+	return parsed
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	pkg "github.com/arun-kushwaha04/DownloadHub/pkg"
+)
+
+func TestParseMetalink(t *testing.T) {
+	sha256Hex := strings.Repeat("ab", 32)
+	sha1Hex := strings.Repeat("cd", 20)
+	sha256Digest := []byte(strings.Repeat("\xab", 32))
+	sha1Digest := []byte(strings.Repeat("\xcd", 20))
+
+	tests := []struct {
+		name     string
+		document string
+		want     *Metalink
+		wantErr  error
+	}{
+		{
+			name: "metalink 4",
+			document: `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="file.iso">
+    <size>1024</size>
+    <hash type="sha-1">` + sha1Hex + `</hash>
+    <hash type="sha-256">` + sha256Hex + `</hash>
+    <pieces type="sha-1" length="512">
+      <hash>` + sha1Hex + `</hash>
+      <hash>` + sha1Hex + `</hash>
+    </pieces>
+    <url location="de" priority="2">http://de.example.com/file.iso</url>
+    <url location="US" priority="1">https://us.example.com/file.iso</url>
+    <url>http://any.example.com/file.iso</url>
+  </file>
+</metalink>`,
+			want: &Metalink{
+				FileName: "file.iso",
+				FileSize: 1024,
+				Checksum: &pkg.Checksum{Algorithm: "sha256", Value: sha256Digest},
+				Pieces:   &pkg.Pieces{Algorithm: "sha1", Length: 512, Hashes: [][]byte{sha1Digest, sha1Digest}},
+				Urls: []MetalinkUrl{
+					{Url: "https://us.example.com/file.iso", Location: "us", Priority: 1},
+					{Url: "http://de.example.com/file.iso", Location: "de", Priority: 2},
+					{Url: "http://any.example.com/file.iso", Priority: metalinkNoPriority},
+				},
+			},
+		},
+		{
+			name: "metalink 3",
+			document: `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="file.iso">
+      <size>2048</size>
+      <verification>
+        <hash type="sha256">` + sha256Hex + `</hash>
+      </verification>
+      <resources>
+        <url type="http" preference="10">http://slow.example.com/file.iso</url>
+        <url type="http" preference="100">http://fast.example.com/file.iso</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`,
+			want: &Metalink{
+				FileName: "file.iso",
+				FileSize: 2048,
+				Checksum: &pkg.Checksum{Algorithm: "sha256", Value: sha256Digest},
+				Urls: []MetalinkUrl{
+					{Url: "http://fast.example.com/file.iso", Priority: 1},
+					{Url: "http://slow.example.com/file.iso", Priority: 91},
+				},
+			},
+		},
+		{
+			name: "file without http url skipped",
+			document: `<metalink>
+  <file name="ftp.iso"><url>ftp://example.com/ftp.iso</url></file>
+  <file name="http.iso"><url>http://example.com/http.iso</url></file>
+</metalink>`,
+			want: &Metalink{
+				FileName: "http.iso",
+				FileSize: pkg.UnknownFileSize,
+				Urls:     []MetalinkUrl{{Url: "http://example.com/http.iso", Priority: metalinkNoPriority}},
+			},
+		},
+		{
+			name: "invalid hashes ignored",
+			document: `<metalink>
+  <file name="file.iso">
+    <hash type="sha-256">abcd</hash>
+    <hash type="crc32">abcd</hash>
+    <pieces type="sha-1" length="512"><hash>zz</hash></pieces>
+    <url>http://example.com/file.iso</url>
+  </file>
+</metalink>`,
+			want: &Metalink{
+				FileName: "file.iso",
+				FileSize: pkg.UnknownFileSize,
+				Urls:     []MetalinkUrl{{Url: "http://example.com/file.iso", Priority: metalinkNoPriority}},
+			},
+		},
+		{name: "not xml", document: "file.iso", wantErr: InvalidMetalink},
+		{name: "no http url", document: `<metalink><file name="file.iso"><url>ftp://example.com/file.iso</url></file></metalink>`, wantErr: InvalidMetalink},
+		{name: "no name", document: `<metalink><file><url>http://example.com/file.iso</url></file></metalink>`, wantErr: InvalidMetalink},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseMetalink(strings.NewReader(test.document))
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got error %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
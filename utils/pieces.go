@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pkg "github.com/arun-kushwaha04/DownloadHub/pkg"
+)
+
+// FindPieces looks for piece hashes of the resource in a sidecar metalink
+// (file.iso.meta4) or in a piece list (file.iso.pieces). A piece list starts
+// with a "<algorithm> <piece length>" line followed by one hex digest per line.
+func FindPieces(ctx context.Context, resourceUrl *url.URL, fileSize int64, headers map[string]string) *pkg.Pieces {
+	for _, extension := range []string{".meta4", ".metalink"} {
+		sidecarUrl := *resourceUrl
+		sidecarUrl.Path += extension
+		sidecarUrl.RawPath = ""
+		metalink, err := FetchMetalink(ctx, &sidecarUrl, headers)
+		if err != nil || metalink.Pieces == nil {
+			continue
+		}
+		if metalink.Pieces.Count(fileSize) == int64(len(metalink.Pieces.Hashes)) {
+			return metalink.Pieces
+		}
+	}
+
+	sidecarUrl := *resourceUrl
+	sidecarUrl.Path += ".pieces"
+	sidecarUrl.RawPath = ""
+	pieces := findPieceList(ctx, &sidecarUrl, headers)
+	if pieces != nil && pieces.Count(fileSize) == int64(len(pieces.Hashes)) {
+		return pieces
+	}
+	return nil
+}
+
+func findPieceList(ctx context.Context, fileUrl *url.URL, headers map[string]string) *pkg.Pieces {
+	client, req, err := GetClient(ctx, "GET", fileUrl, nil, &headers)
+	if err != nil {
+		return nil
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(res.Body, 64*1024*1024))
+	if !scanner.Scan() {
+		return nil
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) != 2 {
+		return nil
+	}
+	algorithm, ok := metalinkAlgorithms[strings.ToLower(fields[0])]
+	length, err := strconv.ParseInt(fields[1], 10, 64)
+	if !ok || err != nil || length <= 0 {
+		return nil
+	}
+
+	pieces := &pkg.Pieces{Algorithm: algorithm, Length: length}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		digest, err := hex.DecodeString(line)
+		if err != nil || len(digest) != pkg.ChecksumSizes[algorithm] {
+			return nil
+		}
+		pieces.Hashes = append(pieces.Hashes, digest)
+	}
+	return pieces
+}
@@ -1,27 +1,68 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	config "github.com/arun-kushwaha04/DownloadHub/configs"
 	pkg "github.com/arun-kushwaha04/DownloadHub/pkg"
 )
 
-func GetClient(method string, url *url.URL, body io.Reader, header *map[string]string) (*http.Client, *http.Request, error) {
-	client := &http.Client{}
+// sidecar files such as checksums are small, their requests share one pool
+var sharedTransport = sync.OnceValue(newTransport)
 
+func GetClient(ctx context.Context, method string, url *url.URL, body io.Reader, header *map[string]string) (*http.Client, *http.Request, error) {
+	client := &http.Client{Transport: sharedTransport()}
+
+	req, err := NewRequest(ctx, method, url, body, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, req, nil
+}
+
+// NewHttpClient returns a client with its own connection pool, connections
+// opened while probing a resource stay idle in it and are reused by the download
+func NewHttpClient() *http.Client {
+	transport := newTransport()
+	transport.MaxIdleConnsPerHost = config.Get().MaxConnections
+	return &http.Client{Transport: transport}
+}
+
+// newTransport applies the connect, TLS handshake and response header timeouts
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.Get().ConnectTimeout) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = time.Duration(config.Get().TLSHandshakeTimeout) * time.Millisecond
+	transport.ResponseHeaderTimeout = time.Duration(config.Get().ResponseHeaderTimeout) * time.Millisecond
+	return transport
+}
+
+func NewRequest(ctx context.Context, method string, url *url.URL, body io.Reader, header *map[string]string) (*http.Request, error) {
 	requestUri := url.String()
-	req, err := http.NewRequest(method, requestUri, body)
+	req, err := http.NewRequestWithContext(ctx, method, requestUri, body)
 
 	if err != nil {
-		return nil, nil, HttpRequestError
+		return nil, NewError(HttpRequestError, err)
 	}
 
 	// adding headers
@@ -29,87 +70,264 @@ func GetClient(method string, url *url.URL, body io.Reader, header *map[string]s
 		req.Header.Add(key, value)
 	}
 	req.Header.Add("Host", url.Hostname())
-	req.Header.Add("User-Agent", config.DEFAULT_USER_AGENT)
+	// a user agent given in the headers wins
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Add("User-Agent", config.Get().UserAgent)
+	}
 
-	return client, req, nil
+	return req, nil
 }
 
-func GetMetaData(resourceString string) (*pkg.ResourceInfo, error) {
+// ScopeHeaders returns the headers given for a download when target is on
+// the host of origin, other hosts such as mirrors get none of them
+func ScopeHeaders(headers map[string]string, origin *url.URL, target *url.URL) map[string]string {
+	if origin == nil || target == nil || !strings.EqualFold(origin.Host, target.Host) {
+		return nil
+	}
+	return headers
+}
+
+// credentialHeaders are never written to disk
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// WithoutCredentials returns the headers without the credential headers
+func WithoutCredentials(headers map[string]string) map[string]string {
+	var kept map[string]string
+	for key, value := range headers {
+		if slices.Contains(credentialHeaders, http.CanonicalHeaderKey(key)) {
+			continue
+		}
+		if kept == nil {
+			kept = make(map[string]string)
+		}
+		kept[key] = value
+	}
+	return kept
+}
+
+// GetMetaData asks the server for the size and range support of a resource
+// with a HEAD request, servers rejecting HEAD or answering it without a size
+// are probed with a GET of the first byte instead. The headers are sent with
+// every request and ctx ends them.
+func GetMetaData(ctx context.Context, resourceString string, headers map[string]string) (*pkg.ResourceInfo, error) {
 
 	parsedUrl, err := url.Parse(resourceString)
 	if err != nil {
-		return nil, URLParseError
+		return nil, NewError(URLParseError, err)
 	}
 
-	fileName := path.Base(parsedUrl.Path)
+	client := NewHttpClient()
 
-	var headers map[string]string
-	client, req, err := GetClient("HEAD", parsedUrl, nil, &headers)
+	req, err := NewRequest(ctx, "HEAD", parsedUrl, nil, &headers)
 	if err != nil {
 		return nil, err
 	}
 
 	res, err := client.Do(req)
+	if err == nil && res.StatusCode < 300 && res.Header.Get("Content-Length") != "" {
+		defer res.Body.Close()
+		return headMetaData(client, parsedUrl, res)
+	}
 	if err != nil {
-		fmt.Println(err)
-		return nil, HttpClientIntalizationError
+		fmt.Println("HEAD request failed, probing with GET", err)
+	} else {
+		res.Body.Close()
 	}
 
-	defer res.Body.Close()
+	return probeMetaData(ctx, client, parsedUrl, headers)
+}
 
-	fileSizeInString := res.Header.Get("Content-Length")
-	if fileSizeInString == "" {
-		return nil, InvalidResourceSize
+func headMetaData(client *http.Client, parsedUrl *url.URL, res *http.Response) (*pkg.ResourceInfo, error) {
+	fileSize, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil || fileSize < 0 {
+		return nil, NewError(InvalidResourceSize, err)
 	}
 
-	fileSize, err := strconv.ParseInt(fileSizeInString, 10, 64)
+	resourceInfo := newResourceInfo(client, parsedUrl, res)
+	resourceInfo.FileSize = fileSize
+	resourceInfo.Resumeable = strings.Contains(res.Header.Get("Accept-Ranges"), "bytes")
+	return resourceInfo, nil
+}
+
+// bytes of a probe response read so its connection goes back to the pool, a
+// server ignoring the range sends the whole file and a larger body is closed
+const probeDrainLimit = 64 * 1024
+
+// probeMetaData requests the first byte, a 206 answer carries the size in
+// Content-Range and proves range support. The body is read so the connection
+// goes back to the pool of the client.
+func probeMetaData(ctx context.Context, client *http.Client, parsedUrl *url.URL, headers map[string]string) (*pkg.ResourceInfo, error) {
+	probeHeaders := map[string]string{}
+	for key, value := range headers {
+		probeHeaders[key] = value
+	}
+	probeHeaders["Range"] = "bytes=0-0"
+	req, err := NewRequest(ctx, "GET", parsedUrl, nil, &probeHeaders)
 	if err != nil {
-		return nil, InvalidResourceSize
+		return nil, err
 	}
 
-	acceptRanges := res.Header.Get("Accept-Ranges")
-	if acceptRanges == "" {
-		// not resumable download
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return nil, NewError(HttpClientIntalizationError, err)
+	}
+	defer res.Body.Close()
+	defer io.Copy(io.Discard, io.LimitReader(res.Body, probeDrainLimit))
+
+	resourceInfo := newResourceInfo(client, parsedUrl, res)
 
-		return &pkg.ResourceInfo{FileSize: fileSize, FileName: fileName, Resumeable: false, Url: parsedUrl}, nil
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		fileSize, err := parseContentRangeSize(res.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		resourceInfo.FileSize = fileSize
+		resourceInfo.Resumeable = fileSize != pkg.UnknownFileSize
+	case http.StatusRequestedRangeNotSatisfiable:
+		// an empty file has no first byte
+		fileSize, err := parseContentRangeSize(res.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		resourceInfo.FileSize = fileSize
+	case http.StatusOK:
+		// range ignored, the body is the whole file, only a small one is read
+		resourceInfo.FileSize = pkg.UnknownFileSize
+		if res.ContentLength >= 0 {
+			resourceInfo.FileSize = res.ContentLength
+		}
+	default:
+		fmt.Println("Metadata probe failed with status", res.StatusCode)
+		return nil, NewError(ServerError, nil).WithStatus(res.StatusCode, 0)
 	}
+	return resourceInfo, nil
+}
 
-	return &pkg.ResourceInfo{FileSize: fileSize, FileName: fileName, Resumeable: true, Url: parsedUrl}, nil
+// newResourceInfo fills everything but the size and range support, redirects
+// were followed so the name is resolved from the final response
+func newResourceInfo(client *http.Client, parsedUrl *url.URL, res *http.Response) *pkg.ResourceInfo {
+	return &pkg.ResourceInfo{
+		FileSize:    pkg.UnknownFileSize,
+		FileName:    GetFileName(res),
+		Url:         parsedUrl,
+		FinalUrl:    res.Request.URL,
+		ETag:        res.Header.Get("ETag"),
+		ContentType: res.Header.Get("Content-Type"),
+		Checksum:    ParseDigestHeader(res.Header),
+		Client:      client,
+	}
 }
 
-func CreateFile(parentDir string, fileName string, fileSize int64) (string, error) {
+// parseContentRangeSize returns the complete length of a "bytes 0-0/1234"
+// header, an unknown length "*" gives UnknownFileSize
+func parseContentRangeSize(contentRange string) (int64, error) {
+	_, size, found := strings.Cut(contentRange, "/")
+	if !found || !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, InvalidResourceSize
+	}
+	if size == "*" {
+		return pkg.UnknownFileSize, nil
+	}
+	fileSize, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || fileSize < 0 {
+		return 0, InvalidResourceSize
+	}
+	return fileSize, nil
+}
 
-	fullPath := filepath.Join(parentDir, fileName)
+// names tried for a download before giving up, "file (1).iso" is the second
+const maxFileNameAttempts = 1000
 
-	fs, err := FileExits(parentDir, fileName, false)
-	if err != nil {
-		return "", err
+// CreateFile creates the temporary file a download is written to and returns
+// its path, the file becomes fileName once RenameFile is called. A number is
+// added to the name when a file or a download with that name already exists
+// in parentDir, existing files are never written to.
+func CreateFile(parentDir string, fileName string, fileSize int64) (string, error) {
+	if err := os.MkdirAll(parentDir, os.ModePerm); err != nil {
+		return "", NewError(DirCreatePermissionError, err)
 	}
 
-	if fs > 1 {
+	ext := filepath.Ext(fileName)
+	for i := range maxFileNameAttempts {
+		name := fileName
+		if i > 0 {
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(fileName, ext), i, ext)
+		}
+		if _, err := os.Stat(filepath.Join(parentDir, name)); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return "", NewError(FileReadPermissionError, err)
+		}
+
+		fullPath := filepath.Join(parentDir, name+config.TEMP_EXT)
+		file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", NewError(FileCreatePermissionError, err)
+		}
+		err = allocate(file, fileSize)
+		file.Close()
+		if err != nil {
+			os.Remove(fullPath)
+			return "", err
+		}
 		return fullPath, nil
 	}
+	return "", NewError(FileAlreadyExists, nil)
+}
 
-	fileName += config.TEMP_EXT
-
-	if err := os.MkdirAll(parentDir, os.ModePerm); err != nil {
-		return "", DirCreatePermissionError
+// OpenFile creates the temporary file of a restored download when it is
+// missing, an existing file holds the progress and is kept as it is
+func OpenFile(fullPath string, fileSize int64) error {
+	if _, err := os.Stat(fullPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return NewError(FileReadPermissionError, err)
 	}
+	return createFile(fullPath, fileSize)
+}
+
+// ResetFile empties the temporary file of a restored download whose progress
+// was discarded and sizes it for the resource
+func ResetFile(fullPath string, fileSize int64) error {
+	return createFile(fullPath, fileSize)
+}
 
+// FinalPath returns the path a temporary download file is renamed to
+func FinalPath(fullPath string) string {
+	return strings.TrimSuffix(fullPath, config.TEMP_EXT)
+}
+
+// createFile creates an empty file of fileSize bytes, the directory included
+func createFile(fullPath string, fileSize int64) error {
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return NewError(DirCreatePermissionError, err)
+	}
 	file, err := os.Create(fullPath)
 	if err != nil {
-		return "", FileCreatePermissionError
+		return NewError(FileCreatePermissionError, err)
 	}
-
 	defer file.Close()
+	return allocate(file, fileSize)
+}
 
-	if fileSize > 0 {
-		if err := file.Truncate(fileSize); err != nil {
-			return "", NoEnoughSpace
+// allocate sets the size of a new file
+func allocate(file *os.File, fileSize int64) error {
+	if fileSize <= 0 {
+		return nil
+	}
+	if err := file.Truncate(fileSize); err != nil {
+		kind := FileWritePermissionError
+		if errors.Is(err, syscall.ENOSPC) {
+			kind = NoEnoughSpace
 		}
+		return NewError(kind, err)
 	}
-
-	return fullPath, nil
+	return nil
 }
 
 func GetByteRangeHeader(start *int64, end *int64) *map[string]string {
@@ -126,7 +344,7 @@ func RenameFile(src string, newFileName string) error {
 	fmt.Println("Renaming download")
 	_, err := os.Stat(src)
 	if os.IsNotExist(err) {
-		return FileNotFound
+		return NewError(FileNotFound, err)
 	}
 
 	if err == nil {
@@ -134,36 +352,65 @@ func RenameFile(src string, newFileName string) error {
 		dest := filepath.Join(dirPath, newFileName)
 
 		if err := os.Rename(src, dest); err != nil {
-			return FileRenameError
+			return NewError(FileRenameError, err)
 		}
 
 		return nil
 	}
 
-	return err
+	return NewError(FileReadPermissionError, err)
 }
 
+// MergeSegment copies the segment file into the file at offset and removes
+// it once the copy is on disk, so a merge never holds a segment twice
 func MergeSegment(offset int64, segmentPath string, filePath string) error {
 
 	srcFile, err := os.Open(segmentPath)
 	if err != nil {
-		return MissingSegmentFile
+		return NewError(MissingSegmentFile, err)
+	}
+	defer srcFile.Close()
+
+	fileInfo, err := srcFile.Stat()
+	if err != nil {
+		return NewError(FileReadPermissionError, err)
 	}
 
 	dstFile, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return MissingMainFile
+		return NewError(MissingMainFile, err)
 	}
 	defer dstFile.Close()
 
-	if _, err := dstFile.Seek(offset, io.SeekStart); err != nil {
-		return FileReadPermissionError
+	if err := copySegment(dstFile, srcFile, offset, fileInfo.Size()); err != nil {
+		return err
+	}
+	if err := dstFile.Sync(); err != nil {
+		return NewError(FileWritePermissionError, err)
 	}
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
-		return FileWritePermissionError
+	if err := os.Remove(segmentPath); err != nil {
+		return NewError(FileWritePermissionError, err)
 	}
+	return nil
+}
 
+// copyRange copies size bytes from srcOffset of src to offset of dst through user space
+func copyRange(dst *os.File, src *os.File, offset int64, srcOffset int64, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	n, err := io.Copy(io.NewOffsetWriter(dst, offset), io.NewSectionReader(src, srcOffset, size))
+	if err != nil {
+		kind := FileWritePermissionError
+		if errors.Is(err, syscall.ENOSPC) {
+			kind = NoEnoughSpace
+		}
+		return NewError(kind, err)
+	}
+	if n < size {
+		return MissingSegmentFile
+	}
 	return nil
 }
 
@@ -178,16 +425,16 @@ func FileExits(parentDir string, fileName string, ifNotCreate bool) (int64, erro
 	}
 	if os.IsNotExist(err) {
 		if ifNotCreate {
-			_, err := CreateFile(parentDir, fileName, 0)
+			err := createFile(path.Join(parentDir, fileName), 0)
 			if err != nil {
-				return 0, FileCreatePermissionError
+				return 0, err
 			}
 			return 0, nil
 		} else {
 			return 0, nil
 		}
 	}
-	return 0, FileReadPermissionError
+	return 0, NewError(FileReadPermissionError, err)
 }
 
 func DeleteAndCreateNewFile(parentDir string, fileName string) error {
@@ -196,42 +443,21 @@ func DeleteAndCreateNewFile(parentDir string, fileName string) error {
 	if err != nil {
 		return err
 	}
-	_, err = CreateFile(parentDir, fileName, 0)
-	if err != nil {
-		return err
-	}
-	return nil
+	return createFile(filePath, 0)
 }
 
 func GetDownloadFolder(ext string) string {
+	conf := config.Get()
 
-	for _, v := range config.VideoExtensions {
-		if v == ext {
-			return filepath.Join(config.DOWNLOAD_DIRECTORY, config.VIDEO_SUB_FOLDER)
-		}
-	}
-	for _, v := range config.MusicExtensions {
-		if v == ext {
-			return filepath.Join(config.DOWNLOAD_DIRECTORY, config.MUSIC_SUB_FOLDER)
-		}
-	}
-	for _, v := range config.ProgramExtensions {
-		if v == ext {
-			return filepath.Join(config.DOWNLOAD_DIRECTORY, config.PROGRAMS_SUB_FOLDER)
-		}
-	}
-	for _, v := range config.CompressedExtensions {
-		if v == ext {
-			return filepath.Join(config.DOWNLOAD_DIRECTORY, config.COMPRESSED_SUB_FOLDER)
-		}
-	}
-	for _, v := range config.DocumentExtensions {
-		if v == ext {
-			return filepath.Join(config.DOWNLOAD_DIRECTORY, config.DOCUMENT_SUB_FOLDER)
+	for _, category := range conf.Categories {
+		for _, v := range category.Extensions {
+			if strings.EqualFold(v, ext) {
+				return filepath.Join(conf.DownloadDirectory, category.Folder)
+			}
 		}
 	}
 
-	return filepath.Join(config.DOWNLOAD_DIRECTORY, config.GENERAL_SUB_FOLDER)
+	return filepath.Join(conf.DownloadDirectory, conf.GeneralFolder)
 
 }
 
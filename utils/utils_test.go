@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	config "github.com/arun-kushwaha04/DownloadHub/configs"
+)
+
+func TestCreateFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		want     string
+	}{
+		{"new file", nil, "file.bin" + config.TEMP_EXT},
+		{"finished file", []string{"file.bin"}, "file (1).bin" + config.TEMP_EXT},
+		{"running download", []string{"file.bin" + config.TEMP_EXT}, "file (1).bin" + config.TEMP_EXT},
+		{"numbered files", []string{"file.bin", "file (1).bin", "file (2).bin" + config.TEMP_EXT}, "file (3).bin" + config.TEMP_EXT},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range test.existing {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			fullPath, err := CreateFile(dir, "file.bin", 1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fullPath != filepath.Join(dir, test.want) {
+				t.Fatalf("got %s, want %s", filepath.Base(fullPath), test.want)
+			}
+			info, err := os.Stat(fullPath)
+			if err != nil || info.Size() != 1024 {
+				t.Fatalf("file not created with its size: %v", err)
+			}
+			for _, name := range test.existing {
+				content, _ := os.ReadFile(filepath.Join(dir, name))
+				if string(content) != "old" {
+					t.Fatalf("existing file %s was changed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenFileKeepsProgress(t *testing.T) {
+	fullPath := filepath.Join(t.TempDir(), "dir", "file.bin"+config.TEMP_EXT)
+	if err := OpenFile(fullPath, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte("progress"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenFile(fullPath, 10); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(fullPath); string(content) != "progress" {
+		t.Fatalf("restored file was replaced: %q", content)
+	}
+	if got := FinalPath(fullPath); filepath.Base(got) != "file.bin" {
+		t.Fatalf("final path %s", got)
+	}
+}
+
+func TestProbeConnectionIsReused(t *testing.T) {
+	config.Set(config.Default())
+	body := bytes.Repeat([]byte("x"), 32*1024)
+
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// the range is ignored, the whole file is sent
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	resourceInfo, err := GetMetaData(context.Background(), server.URL+"/file.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resourceInfo.FileSize != int64(len(body)) || resourceInfo.Resumeable {
+		t.Fatalf("size %d resumeable %v", resourceInfo.FileSize, resourceInfo.Resumeable)
+	}
+	res, err := resourceInfo.Client.Get(server.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if got := connections.Load(); got != 1 {
+		t.Fatalf("%d connections opened, the probe connection was not reused", got)
+	}
+}